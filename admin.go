@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// admin restricts the handler to the requests bearing the admin token.
+func (s *service) admin(h httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			writeError(rw, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+
+		h(rw, r, p)
+	}
+}
+
+// getDescriptions returns the current descriptions. The map must not be
+// modified.
+func (s *service) getDescriptions() map[string]description {
+	s.descriptionsMu.RLock()
+	defer s.descriptionsMu.RUnlock()
+	return s.descriptions
+}
+
+// getAliases returns the current aliases of the descriptions. The map must
+// not be modified.
+func (s *service) getAliases() map[string]string {
+	s.descriptionsMu.RLock()
+	defer s.descriptionsMu.RUnlock()
+	return s.aliases
+}
+
+// setDescription replaces a single description, leaving the others as they
+// are. The description is rejected if its aliases collide with the others.
+func (s *service) setDescription(name string, desc description) error {
+	s.descriptionsMu.Lock()
+	defer s.descriptionsMu.Unlock()
+
+	descriptions := make(map[string]description, len(s.descriptions)+1)
+	for k, v := range s.descriptions {
+		descriptions[k] = v
+	}
+	descriptions[name] = desc
+
+	aliases, err := aliasesOf(descriptions)
+	if err != nil {
+		return err
+	}
+
+	s.descriptions = descriptions
+	s.aliases = aliases
+	return nil
+}
+
+// reloadDescription reads the description of a base again from its source,
+// and replaces the current one with it once checked like the descriptions
+// read at startup: blocks out of the image are only logged, and an unreadable
+// base is tolerated when there is a placeholder. Its base image is read again
+// too. The other descriptions are kept as they are, even if they changed, and
+// the files of the descriptions directory other than the description's aren't
+// read, so they can't prevent the reload.
+func (s *service) reloadDescription(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := resolveBase(s.getAliases(), p.ByName("base"), s.caseSensitiveBases)
+
+	desc, ok, err := s.readSourceDescription(name)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidDescription, err))
+		return
+	}
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeError(rw, http.StatusNotFound, badRequest(codeUnknownBase, fmt.Errorf(`unknown base %q`, name)))
+		return
+	}
+
+	desc, err = prepareDescription(desc)
+	if err == nil {
+		err = checkBases(map[string]description{name: desc})
+		if err != nil && s.placeholder != nil {
+			s.logger.Warn("checking bases", "err", err)
+			err = nil
+		}
+	}
+	if err == nil {
+		err = checkFonts(s.fonts, map[string]description{name: desc})
+	}
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidDescription, wrap(err, "description %q", name)))
+		return
+	}
+
+	for _, err := range validateDescription(name, desc) {
+		s.logger.Warn("validating description", "err", err)
+	}
+
+	old, ok := s.getDescriptions()[name]
+	err = s.setDescription(name, desc)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, wrap(err, "description %q", name))
+		return
+	}
+
+	if ok && old.Base != "" {
+		s.baseCache.forget(old.Base)
+	}
+	s.baseCache.forget(desc.Base)
+	s.logger.Info("reloaded description", "base", name)
+
+	write(rw, http.StatusOK, desc)
+}
+
+// readSourceDescription reads the description of the base from its file in
+// the descriptions directory if it has one, from the descriptions file
+// otherwise. It returns false if neither has it.
+func (s *service) readSourceDescription(name string) (description, bool, error) {
+	if s.descriptionsDir != "" {
+		path, err := s.descriptionFile(name)
+		if err != nil {
+			return description{}, false, err
+		}
+		if path != "" {
+			n, desc, err := readDescription(path)
+			if err != nil {
+				return description{}, false, err
+			}
+			descriptions, err := normalizeNames(map[string]description{n: desc}, s.caseSensitiveBases)
+			if err != nil {
+				return description{}, false, err
+			}
+			return descriptions[name], true, nil
+		}
+	}
+
+	if s.descriptionsPath == "" {
+		return description{}, false, nil
+	}
+
+	descriptions, err := s.readDescriptionsFile()
+	if err != nil {
+		return description{}, false, err
+	}
+	descriptions, err = normalizeNames(descriptions, s.caseSensitiveBases)
+	if err != nil {
+		return description{}, false, err
+	}
+	desc, ok := descriptions[name]
+	return desc, ok, nil
+}
+
+// putDescription replaces the description of a base with the one sent, or
+// adds it, once checked like the descriptions read at startup along with its
+// base image and fonts. With -admin-persist, it is also written back to the
+// descriptions sources, so it is kept across restarts.
+func (s *service) putDescription(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := resolveBase(s.getAliases(), p.ByName("base"), s.caseSensitiveBases)
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "reading body")))
+		return
+	}
+
+	var desc description
+	err = json.Unmarshal(raw, &desc)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(jsonError(raw, err), "parsing description")))
+		return
+	}
+
+	prepared, err := normalizeNames(map[string]description{name: desc}, s.caseSensitiveBases)
+	if err == nil {
+		desc, err = prepareDescription(prepared[name])
+	}
+	if err == nil {
+		errs := validateDescription(name, desc)
+		if len(errs) != 0 {
+			err = errs[0]
+		}
+	}
+	if err == nil {
+		err = checkFonts(s.fonts, map[string]description{name: desc})
+	}
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, err))
+		return
+	}
+
+	old, ok := s.getDescriptions()[name]
+	err = s.setDescription(name, desc)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, err))
+		return
+	}
+
+	if ok && old.Base != "" {
+		s.baseCache.forget(old.Base)
+	}
+	s.baseCache.forget(desc.Base)
+	s.logger.Info("replaced description", "base", name)
+
+	if s.adminPersist {
+		err = s.persistDescription(name, raw)
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, wrap(err, "description %q replaced but not persisted", name))
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusCreated
+	}
+	write(rw, status, desc)
+}
+
+// persistDescription writes the description back where it was read from: its
+// file in the descriptions directory, or the descriptions file. New
+// descriptions go to the descriptions file if there is one, the directory
+// otherwise.
+func (s *service) persistDescription(name string, raw []byte) error {
+	if s.descriptionsDir != "" {
+		path, err := s.descriptionFile(name)
+		if err != nil {
+			return err
+		}
+		if path == "" && s.descriptionsPath == "" {
+			path = filepath.Join(s.descriptionsDir, name+".json")
+		}
+		if path != "" {
+			// Files named otherwise are named by their name field.
+			if normalizeBase(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), s.caseSensitiveBases) != name {
+				raw, err = withName(raw, name)
+				if err != nil {
+					return err
+				}
+			}
+
+			var indented bytes.Buffer
+			err = json.Indent(&indented, raw, "", "\t")
+			if err != nil {
+				return wrap(err, "formatting description")
+			}
+			return writeFile(path, indented.Bytes())
+		}
+	}
+
+	content, err := ioutil.ReadFile(s.descriptionsPath)
+	if err != nil {
+		return wrap(err, "reading descriptions file")
+	}
+
+	var descriptions map[string]json.RawMessage
+	err = json.Unmarshal(content, &descriptions)
+	if err != nil {
+		return wrap(jsonError(content, err), "parsing descriptions file %q", s.descriptionsPath)
+	}
+
+	// The description may be keyed by a name normalized since.
+	for key := range descriptions {
+		if normalizeBase(key, s.caseSensitiveBases) == name {
+			delete(descriptions, key)
+		}
+	}
+	descriptions[name] = raw
+
+	content, err = json.MarshalIndent(descriptions, "", "\t")
+	if err != nil {
+		return wrap(err, "formatting descriptions")
+	}
+	return writeFile(s.descriptionsPath, content)
+}
+
+// withName sets the name field of the raw description.
+func withName(raw []byte, name string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, wrap(err, "parsing description")
+	}
+
+	fields["name"], err = json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// descriptionFile returns the path of the file of the descriptions directory
+// the description is read from, or an empty string if there is none. Files
+// that can't be read are skipped, unless they are named after the
+// description.
+func (s *service) descriptionFile(name string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.descriptionsDir, "*.json"))
+	if err != nil {
+		return "", wrap(err, "listing descriptions directory")
+	}
+
+	for _, path := range paths {
+		n, _, err := readDescription(path)
+		if err != nil && normalizeBase(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), s.caseSensitiveBases) == name {
+			return "", err
+		}
+		if err != nil {
+			continue
+		}
+		if normalizeBase(n, s.caseSensitiveBases) == name {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+// writeFile replaces the content of the file at path, through a temporary
+// file renamed over it, so readers never see it half written.
+func writeFile(path string, content []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, append(content, '\n'), 0644)
+	if err != nil {
+		return wrap(err, "writing %q", tmp)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return wrap(err, "renaming %q", tmp)
+	}
+	return nil
+}
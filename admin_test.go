@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestReloadDescription(t *testing.T) {
+	dir, err := ioutil.TempDir("", "descriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	s := newTestService(t)
+	s.descriptionsDir = dir
+
+	writeDescription := func(name, content string) {
+		t.Helper()
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDescription("broken.json", `{"width": 100,`)
+
+	for _, c := range []struct {
+		name   string
+		desc   string
+		status int
+		code   string
+		size   float64
+	}{
+		{
+			name:   "valid",
+			desc:   `{"width": 400, "height": 300, "question": {"size": 30, "x": 20, "y": 40}, "answers": []}`,
+			status: http.StatusOK,
+			size:   30,
+		},
+		{
+			name:   "invalid block",
+			desc:   `{"width": 400, "height": 300, "question": {"size": 30, "lineHeight": -1, "x": 20, "y": 40}, "answers": []}`,
+			status: http.StatusBadRequest,
+			code:   codeInvalidDescription,
+			size:   30,
+		},
+		{
+			name:   "malformed file",
+			desc:   `{"width": 400,`,
+			status: http.StatusBadRequest,
+			code:   codeInvalidDescription,
+			size:   30,
+		},
+		{
+			name:   "block outside of the image",
+			desc:   `{"width": 400, "height": 300, "question": {"size": 40, "x": 500, "y": 40}, "answers": []}`,
+			status: http.StatusOK,
+			size:   40,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			writeDescription("test.json", c.desc)
+
+			rw := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/admin/reload/test", nil)
+			s.reloadDescription(rw, r, httprouter.Params{{Key: "base", Value: "test"}})
+
+			if rw.Code != c.status {
+				t.Errorf("expected status %d, got %d: %s", c.status, rw.Code, rw.Body)
+			}
+			if c.code != "" {
+				var res Error
+				err := json.Unmarshal(rw.Body.Bytes(), &res)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Code != c.code {
+					t.Errorf("expected code %q, got %q", c.code, res.Code)
+				}
+			}
+			if size := s.getDescriptions()["test"].Question.Size; size != c.size {
+				t.Errorf("expected a question of size %v, got %v", c.size, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"image"
+	"sort"
+	"sync"
+)
+
+// baseCache holds the decoded base images, keyed by path. Images are decoded
+// on first use, or all at once at startup with -preload.
+type baseCache struct {
+	mu     sync.RWMutex
+	images map[string]image.Image
+}
+
+// newBaseCache returns an empty cache.
+func newBaseCache() *baseCache {
+	return &baseCache{
+		images: make(map[string]image.Image),
+	}
+}
+
+// get returns the decoded image at path, decoding it if it isn't cached yet.
+// Cached images are shared, and must not be modified.
+func (c *baseCache) get(path string) (image.Image, error) {
+	c.mu.RLock()
+	img, ok := c.images[path]
+	c.mu.RUnlock()
+	if ok {
+		return img, nil
+	}
+
+	img, err := readImage(path)
+	if err != nil {
+		return nil, wrap(err, "reading base image")
+	}
+
+	c.mu.Lock()
+	c.images[path] = img
+	c.mu.Unlock()
+	return img, nil
+}
+
+// forget removes the image at path from the cache, so it is decoded again on
+// next use.
+func (c *baseCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.images, path)
+}
+
+// preload decodes the bases of all the descriptions, along with the images of
+// their layers, and returns the number of images decoded.
+func (c *baseCache) preload(descriptions map[string]description) (int, error) {
+	for name, desc := range descriptions {
+		var paths []string
+		if desc.Base != "" {
+			paths = append(paths, desc.Base)
+		}
+		for _, l := range desc.Layers {
+			if l.Type == layerImage {
+				paths = append(paths, l.Path)
+			}
+		}
+
+		for _, path := range paths {
+			_, err := c.get(path)
+			if err != nil {
+				return 0, wrap(err, "description %q", name)
+			}
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.images), nil
+}
+
+// checkBases checks that the bases of the descriptions can be read and are in
+// a supported format, without decoding them entirely. The first error found,
+// in the order of the names of the descriptions, is returned.
+func checkBases(descriptions map[string]description) error {
+	var names []string
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		desc := descriptions[name]
+		if desc.Base == "" {
+			continue
+		}
+
+		_, err := decodeConfig(desc.Base)
+		if err != nil {
+			return wrap(err, "description %q", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/xid"
+)
+
+// batchOffers are the formats of batch responses, the first one being the
+// default.
+var batchOffers = []string{"multipart/mixed", "application/json"}
+
+// batchResult is the result of an item of a batch, in JSON responses: either
+// the URL of the image, shared as by /share, or the error.
+type batchResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	URL    string `json:"url,omitempty"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+// batch generates several images in a single request. The body is a list of
+// payloads, and the response a multipart/mixed message with one part per
+// payload, in order, tagged with its index. Items failing to decode or to
+// generate are reported by a JSON error part instead of failing the whole
+// batch.
+//
+// Clients accepting JSON get a multi-status list of results instead, so they
+// can retry only the items that failed.
+func (s *service) batch(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	err := r.ParseForm()
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "parsing form")))
+		return
+	}
+
+	// The items are decoded one by one, so that an invalid item only fails
+	// itself.
+	var payloads []json.RawMessage
+	err = read(r, &payloads)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "parsing payload")))
+		return
+	}
+
+	if len(payloads) == 0 || len(payloads) > s.maxBatch {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, fmt.Errorf(`batch must contain between 1 and %d items`, s.maxBatch)))
+		return
+	}
+
+	rw.Header().Add("Vary", "Accept")
+	if negotiate(r.Header.Get("Accept"), batchOffers) == "application/json" {
+		s.batchResults(rw, r, payloads)
+		return
+	}
+
+	mw := multipart.NewWriter(rw)
+	rw.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	rw.WriteHeader(http.StatusOK)
+
+	for i, p := range payloads {
+		h := make(textproto.MIMEHeader)
+		h.Set("X-Index", strconv.Itoa(i))
+
+		var body bytes.Buffer
+		err := s.batchItem(r, i, p, &body)
+		if err != nil {
+			body.Reset()
+			h.Set("Content-Type", "application/json")
+			h.Set("X-Status", strconv.Itoa(status(err)))
+			raw, _ := json.Marshal(Error{
+				Err:  err.Error(),
+				Code: errorCode(status(err), err),
+			})
+			body.Write(raw)
+		} else {
+			h.Set("Content-Type", "image/png")
+		}
+
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			s.logger.Error("writing batch response", "err", err)
+			return
+		}
+
+		_, err = part.Write(body.Bytes())
+		if err != nil {
+			s.logger.Error("writing batch response", "err", err)
+			return
+		}
+	}
+
+	err = mw.Close()
+	if err != nil {
+		s.logger.Error("writing batch response", "err", err)
+	}
+}
+
+// batchResults generates the items of the batch, shares the images, and
+// writes the results as JSON.
+func (s *service) batchResults(rw http.ResponseWriter, r *http.Request, payloads []json.RawMessage) {
+	results := make([]batchResult, len(payloads))
+	for i, p := range payloads {
+		var body bytes.Buffer
+		err := s.batchItem(r, i, p, &body)
+		if err == nil {
+			// Items ids aren't valid image ids, images get their own.
+			var id string
+			var created bool
+			id, created, err = s.storeImage(xid.New().String(), body.Bytes())
+			results[i] = batchResult{Index: i, Status: http.StatusOK, URL: "/i/" + id}
+			if created {
+				results[i].Status = http.StatusCreated
+			}
+			if err != nil {
+				err = wrap(err, "storing image")
+			}
+		}
+
+		if err != nil {
+			results[i] = batchResult{
+				Index:  i,
+				Status: status(err),
+				Error: &Error{
+					Err:  err.Error(),
+					Code: errorCode(status(err), err),
+				},
+			}
+		}
+	}
+
+	write(rw, http.StatusMultiStatus, results)
+}
+
+// batchItem decodes the ith item of the batch and generates it as a PNG
+// image.
+func (s *service) batchItem(r *http.Request, i int, raw json.RawMessage, w io.Writer) error {
+	req := s.newGenerateRequest(r)
+	req.uid = fmt.Sprintf("%s-%d", requestID(r.Context()), i)
+	req.init()
+	err := json.Unmarshal(raw, &req.payload)
+	if err != nil {
+		req.err = badRequest(codeInvalidPayload, wrap(err, "parsing payload"))
+	}
+	req.render()
+
+	if req.err == nil {
+		req.err = req.encode(w, "image/png")
+		req.logTimings()
+	}
+	if req.err != nil {
+		req.logger.Error("generating batch item", "err", req.err)
+	}
+	return req.err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchInvalidItems(t *testing.T) {
+	s := newTestService(t)
+
+	body := `[
+		{"question": "Quelle est la capitale ?", "answers": ["Paris", "Lyon"]},
+		{"question": "Combien ?", "answers": [1]},
+		{"question": "Qui ?", "answers": ["Moi"], "correct": "0"},
+		{"question": "Où ?", "answers": ["Ici", "Là"], "correct": 1}
+	]`
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	rw := httptest.NewRecorder()
+	s.batch(rw, r, nil)
+
+	if rw.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusMultiStatus, rw.Code, rw.Body)
+	}
+
+	var results []batchResult
+	err := json.Unmarshal(rw.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{http.StatusCreated, http.StatusBadRequest, http.StatusBadRequest, http.StatusCreated}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if res.Index != i {
+			t.Errorf("result %d: unexpected index %d", i, res.Index)
+		}
+		if res.Status != expected[i] {
+			t.Errorf("result %d: expected status %d, got %d", i, expected[i], res.Status)
+		}
+		if res.Status == http.StatusBadRequest && (res.Error == nil || res.Error.Code != codeInvalidPayload) {
+			t.Errorf("result %d: expected an %s error, got %+v", i, codeInvalidPayload, res.Error)
+		}
+		if res.Status == http.StatusCreated && !strings.HasPrefix(res.URL, "/i/") {
+			t.Errorf("result %d: unexpected URL %q", i, res.URL)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// compressions are the encodings responses can be compressed with, the first
+// one being preferred.
+var compressions = []string{"gzip", "deflate"}
+
+// compress is a middleware compressing the responses for clients that accept
+// it, with gzip or deflate. Images are already compressed, so they are sent
+// as is.
+func (s *service) compress(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rw.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), compressions)
+	if encoding == "" {
+		next(rw, r)
+		return
+	}
+
+	cw := &compressWriter{ResponseWriter: rw, encoding: encoding}
+	defer cw.Close()
+	next(cw, r)
+}
+
+// negotiateEncoding returns the encoding the Accept-Encoding header gives the
+// highest quality value, the first one of the list on ties, or an empty string
+// if it accepts none of them.
+func negotiateEncoding(accept string, encodings []string) string {
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q := encodingQuality(accept, encoding)
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// encodingQuality returns the quality value the Accept-Encoding header gives
+// to the encoding, named or matched by the * wildcard. Encodings with a zero
+// quality, or absent from the header, are refused.
+func encodingQuality(accept string, encoding string) float64 {
+	q, specificity := 0.0, -1
+	for _, e := range strings.Split(accept, ",") {
+		params := strings.Split(e, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch coding {
+		case encoding:
+			s = 1
+		case "*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, qValue(params[1:])
+	}
+	return q
+}
+
+// compressWriter decides whether to compress the response when the headers
+// are written, depending on the content type of the response.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	cw          io.WriteCloser
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(h.Get("Content-Type"), "image/") {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.cw = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			// The deflate content coding is actually the zlib format.
+			w.cw = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.cw == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.cw.Write(b)
+}
+
+// Close flushes the compressed stream, if any.
+func (w *compressWriter) Close() error {
+	if w.cw == nil {
+		return nil
+	}
+	return w.cw.Close()
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, c := range []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: ""},
+		{accept: "gzip", expected: "gzip"},
+		{accept: "deflate, gzip", expected: "gzip"},
+		{accept: "deflate", expected: "deflate"},
+		{accept: "GZIP", expected: "gzip"},
+		{accept: "br", expected: ""},
+		{accept: "gzip;q=0, identity", expected: ""},
+		{accept: "gzip;q=0, deflate", expected: "deflate"},
+		{accept: "gzip;q=0.5, deflate", expected: "deflate"},
+		{accept: "gzip;q=0.8, deflate;q=0.9", expected: "deflate"},
+		{accept: "gzip;q=1.0, deflate;q=1.0", expected: "gzip"},
+		{accept: "*", expected: "gzip"},
+		{accept: "*;q=0", expected: ""},
+		{accept: "gzip;q=0, *", expected: "deflate"},
+		{accept: "deflate;q=0.5, *;q=0.1", expected: "deflate"},
+	} {
+		got := negotiateEncoding(c.accept, compressions)
+		if got != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.accept, c.expected, got)
+		}
+	}
+}
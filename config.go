@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// envPrefixes are the prefixes of the environment variables configuring the
+// service, by order of precedence. The short one predates the other, and is
+// kept for compatibility.
+var envPrefixes = []string{"VOTREDERNIERMOT_", "VDM_"}
+
+// envName returns the name of the environment variable for a flag: the flag
+// name in upper case, dashes replaced by underscores, and prefixed.
+func envName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// lookupEnv returns the value of the first environment variable set for the
+// flag, and its name.
+func lookupEnv(name string) (string, string, bool) {
+	for _, prefix := range envPrefixes {
+		value, ok := os.LookupEnv(envName(prefix, name))
+		if ok {
+			return value, envName(prefix, name), true
+		}
+	}
+	return "", "", false
+}
+
+// loadEnv sets the flags that weren't set on the command line from their
+// environment variables, if any.
+func loadEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+
+		value, env, ok := lookupEnv(f.Name)
+		if !ok {
+			return
+		}
+
+		err = fs.Set(f.Name, value)
+		if err != nil {
+			err = wrap(err, "setting option %q from %s", f.Name, env)
+		}
+	})
+	return err
+}
+
+// loadConfig reads a JSON configuration file whose keys are flag names, and
+// sets the flags that weren't set on the command line accordingly.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return wrap(err, "reading configuration file")
+	}
+
+	// Numbers are kept as their textual representation, so they can be
+	// parsed by the flags themselves.
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&values)
+	if err != nil {
+		return wrap(err, "parsing configuration file")
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, value := range values {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf(`unknown option %q in configuration file`, name)
+		}
+
+		if set[name] {
+			continue
+		}
+
+		err = fs.Set(name, fmt.Sprint(value))
+		if err != nil {
+			return wrap(err, "setting option %q from configuration file", name)
+		}
+	}
+
+	return nil
+}
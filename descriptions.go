@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// loadDescriptions reads the descriptions from the descriptions file and the
+// descriptions directory, if they are configured, and checks them.
+func (s *service) loadDescriptions() (map[string]description, error) {
+	descriptions, err := s.readDescriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, desc := range descriptions {
+		desc, err := prepareDescription(desc)
+		if err != nil {
+			return nil, wrap(err, "description %q", name)
+		}
+		descriptions[name] = desc
+	}
+
+	return descriptions, nil
+}
+
+// readDescriptions reads the descriptions from the descriptions file and the
+// descriptions directory, without checking them.
+func (s *service) readDescriptions() (map[string]description, error) {
+	descriptions := make(map[string]description)
+
+	if s.descriptionsPath != "" {
+		var err error
+		descriptions, err = s.readDescriptionsFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.descriptionsDir != "" {
+		paths, err := filepath.Glob(filepath.Join(s.descriptionsDir, "*.json"))
+		if err != nil {
+			return nil, wrap(err, "listing descriptions directory")
+		}
+
+		for _, path := range paths {
+			name, desc, err := readDescription(path)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := descriptions[name]; ok {
+				return nil, fmt.Errorf(`duplicate description %q in %q`, name, path)
+			}
+			descriptions[name] = desc
+		}
+	}
+
+	return normalizeNames(descriptions, s.caseSensitiveBases)
+}
+
+// readDescriptionsFile reads the descriptions of the descriptions file, keyed
+// by their names as written.
+func (s *service) readDescriptionsFile() (map[string]description, error) {
+	raw, err := ioutil.ReadFile(s.descriptionsPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf(`descriptions file %q not found, set its path with -descriptions, or disable it with -descriptions "" to only use -descriptions-dir`, s.descriptionsPath)
+	}
+	if err != nil {
+		return nil, wrap(err, "reading descriptions file")
+	}
+
+	var descriptions map[string]description
+	err = json.Unmarshal(raw, &descriptions)
+	if err != nil {
+		return nil, wrap(jsonError(raw, err), "parsing descriptions file %q", s.descriptionsPath)
+	}
+	return descriptions, nil
+}
+
+// normalizeNames returns the descriptions keyed by their normalized names,
+// with their aliases normalized too. Names only differing by their case are
+// an error unless case is significant.
+func normalizeNames(descriptions map[string]description, caseSensitive bool) (map[string]description, error) {
+	normalized := make(map[string]description, len(descriptions))
+	for name, desc := range descriptions {
+		key := normalizeBase(name, caseSensitive)
+		if _, ok := normalized[key]; ok {
+			return nil, fmt.Errorf(`duplicate description %q once normalized, use -case-sensitive-bases to keep names differing by their case`, key)
+		}
+
+		aliases := make([]string, len(desc.Aliases))
+		for i, alias := range desc.Aliases {
+			aliases[i] = normalizeBase(alias, caseSensitive)
+		}
+		if len(aliases) != 0 {
+			desc.Aliases = aliases
+		}
+		normalized[key] = desc
+	}
+	return normalized, nil
+}
+
+// normalizeBase returns the requested base name without surrounding spaces
+// and trailing slashes, lowercased unless case is significant.
+func normalizeBase(name string, caseSensitive bool) string {
+	name = strings.TrimRight(strings.TrimSpace(name), "/")
+	if !caseSensitive {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// aliasesOf maps the aliases of the descriptions to their names. Aliases must
+// not collide with each other, nor with the names of the descriptions.
+func aliasesOf(descriptions map[string]description) (map[string]string, error) {
+	var names []string
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	aliases := make(map[string]string)
+	for _, name := range names {
+		for _, alias := range descriptions[name].Aliases {
+			if alias == "" {
+				return nil, fmt.Errorf(`description %q has an empty alias`, name)
+			}
+			if _, ok := descriptions[alias]; ok {
+				return nil, fmt.Errorf(`alias %q of description %q is the name of a description`, alias, name)
+			}
+			if other, ok := aliases[alias]; ok {
+				return nil, fmt.Errorf(`alias %q of description %q is already an alias of description %q`, alias, name, other)
+			}
+			aliases[alias] = name
+		}
+	}
+	return aliases, nil
+}
+
+// resolveBase returns the name of the description named or aliased name,
+// once normalized.
+func resolveBase(aliases map[string]string, name string, caseSensitive bool) string {
+	name = normalizeBase(name, caseSensitive)
+	if key, ok := aliases[name]; ok {
+		return key
+	}
+	return name
+}
+
+// prepareDescription lays out the grid or the balanced layout of the
+// description, if any, and checks the result.
+func prepareDescription(desc description) (description, error) {
+	desc, err := desc.withGrid()
+	if err != nil {
+		return desc, err
+	}
+
+	desc, err = desc.withBalance()
+	if err != nil {
+		return desc, err
+	}
+
+	return desc, checkDescription(desc)
+}
+
+// checkDescription checks the consistency of a description on its own,
+// without accessing its resources.
+func checkDescription(desc description) error {
+	if (desc.Width == 0) != (desc.Height == 0) {
+		return fmt.Errorf("width and height must be declared together")
+	}
+
+	if desc.Width < 0 || desc.Width > maxDimension || desc.Height < 0 || desc.Height > maxDimension {
+		return fmt.Errorf("dimensions %dx%d out of bounds, must be between 1 and %d", desc.Width, desc.Height, maxDimension)
+	}
+
+	if desc.Base == "" && desc.Width == 0 {
+		return fmt.Errorf("either a base or dimensions must be declared")
+	}
+
+	if _, ok := extensions[desc.Format]; desc.Format != "" && !ok {
+		return fmt.Errorf("unknown format %q, must be png, jpg or jpeg", desc.Format)
+	}
+
+	if desc.Colors != 0 && (desc.Colors < 2 || desc.Colors > maxColors) {
+		return fmt.Errorf("%d colors out of bounds, must be between 2 and %d", desc.Colors, maxColors)
+	}
+
+	if a := desc.SafeArea; a.Top < 0 || a.Right < 0 || a.Bottom < 0 || a.Left < 0 {
+		return fmt.Errorf("safe area insets must be positive")
+	}
+
+	if desc.MaxAnswers < 0 || desc.MaxAnswers > len(desc.Answers) {
+		return fmt.Errorf("maximum answers %d out of bounds, must be between 0 and %d", desc.MaxAnswers, len(desc.Answers))
+	}
+
+	colors := []string{desc.Background, desc.Highlight.Color, desc.Highlight.Background, desc.Question.Color, desc.Question.Background, desc.Question.ShadowColor, desc.Question.StrokeColor}
+	for _, b := range desc.Answers {
+		colors = append(colors, b.Color, b.Background, b.ShadowColor, b.StrokeColor)
+	}
+	for _, b := range desc.Static {
+		colors = append(colors, b.Color, b.Background, b.ShadowColor, b.StrokeColor)
+	}
+	for _, l := range desc.Layers {
+		colors = append(colors, l.Color, l.Background, l.ShadowColor, l.StrokeColor)
+	}
+	for _, c := range colors {
+		if c == "" {
+			continue
+		}
+		_, err := parseColor(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	blocks := append([]block{desc.Question}, desc.Answers...)
+	blocks = append(blocks, desc.Static...)
+	for _, l := range desc.Layers {
+		blocks = append(blocks, l.block)
+	}
+	for _, b := range blocks {
+		if b.Hollow && b.StrokeWidth == 0 {
+			return fmt.Errorf("hollow blocks must have a stroke width, or nothing would be drawn")
+		}
+		if b.Gradient == nil {
+			continue
+		}
+		err := b.Gradient.check()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, l := range desc.Layers {
+		err := l.check(desc)
+		if err != nil {
+			return wrap(err, "layer %d", i)
+		}
+	}
+
+	// The blocks drawn are checked on their own here, and against the
+	// dimensions of the image by validateDescription.
+	for _, l := range desc.layers() {
+		if l.Type == layerQuestion {
+			if errs := checkBlock(desc.Question); len(errs) != 0 {
+				return wrap(errs[0], "question")
+			}
+		}
+		if l.Type == layerAnswer {
+			if errs := checkBlock(desc.Answers[l.Answer]); len(errs) != 0 {
+				return wrap(errs[0], "answer %d", l.Answer)
+			}
+		}
+	}
+	for i, l := range desc.Layers {
+		if errs := checkBlock(l.block); l.Type == layerText && len(errs) != 0 {
+			return wrap(errs[0], "layer %d", i)
+		}
+	}
+	for i, b := range desc.Static {
+		if errs := checkBlock(b); len(desc.Layers) == 0 && len(errs) != 0 {
+			return wrap(errs[0], "static block %d", i)
+		}
+	}
+
+	return nil
+}
+
+// jsonError locates the decoding error of the JSON document, by line and
+// column, when it is a syntax or type error. Other errors are returned as is.
+func jsonError(raw []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	before := raw[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return wrap(err, "line %d, column %d", line, column)
+}
+
+// readDescription reads a single description file. The description is named
+// after its name field, or after the file if the field is empty.
+func readDescription(path string) (string, description, error) {
+	var desc description
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", desc, wrap(err, "reading description file %q", path)
+	}
+
+	err = json.Unmarshal(raw, &desc)
+	if err != nil {
+		return "", desc, wrap(jsonError(raw, err), "parsing description file %q", path)
+	}
+
+	name := desc.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return name, desc, nil
+}
+
+// validate checks the descriptions for errors that would only show up when
+// generating images, and returns all of them.
+func (s *service) validate() []error {
+	var names []string
+	for name := range s.descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		errs = append(errs, validateDescription(name, s.descriptions[name])...)
+	}
+	return errs
+}
+
+// validateDescription checks that the base image of a description is usable
+// and that its blocks fit inside it.
+func validateDescription(name string, desc description) []error {
+	cfg, err := dimensions(desc)
+	if err != nil {
+		return []error{wrap(err, "description %q", name)}
+	}
+
+	var errs []error
+	if desc.Width != 0 && desc.Base != "" {
+		_, err := decodeConfig(desc.Base)
+		if err != nil {
+			errs = append(errs, wrap(err, "description %q", name))
+		}
+	}
+
+	errs = append(errs, validateBlock(cfg, desc.Question, "description %q: question", name)...)
+	for i, b := range desc.Answers {
+		errs = append(errs, validateBlock(cfg, b, "description %q: answer %d", name, i)...)
+	}
+	for i, b := range desc.Static {
+		errs = append(errs, validateBlock(cfg, b, "description %q: static block %d", name, i)...)
+	}
+	for i, l := range desc.Layers {
+		switch l.Type {
+		case layerText:
+			errs = append(errs, validateBlock(cfg, l.block, "description %q: layer %d", name, i)...)
+		case layerImage:
+			_, err := decodeConfig(l.Path)
+			if err != nil {
+				errs = append(errs, wrap(err, "description %q: layer %d", name, i))
+			}
+		}
+	}
+	return errs
+}
+
+// validateBlock checks that a block is well-formed and fits in an image of the
+// given dimensions. The message and its arguments are used to prefix errors.
+func validateBlock(cfg image.Config, b block, msg string, args ...interface{}) []error {
+	errs := checkBlock(b)
+
+	x := b.X.resolve(cfg.Width)
+	if !b.Centered && (x < 0 || x > cfg.Width) {
+		errs = append(errs, fmt.Errorf("abscissa %d out of bounds [0, %d]", x, cfg.Width))
+	}
+
+	y := b.Y.resolve(cfg.Height)
+	if y < 0 || y > cfg.Height {
+		errs = append(errs, fmt.Errorf("ordinate %d out of bounds [0, %d]", y, cfg.Height))
+	}
+
+	for i := range errs {
+		errs[i] = wrap(errs[i], msg, args...)
+	}
+	return errs
+}
+
+// checkBlock checks that a block is well-formed, whatever the image it is
+// drawn on.
+func checkBlock(b block) []error {
+	var errs []error
+
+	if b.Size <= 0 || b.Size > maxDimension {
+		errs = append(errs, fmt.Errorf("invalid size %v, must be between 0 and %d", b.Size, maxDimension))
+	}
+
+	if b.Width < 0 {
+		errs = append(errs, fmt.Errorf("invalid width %v", b.Width))
+	}
+
+	if b.MaxLines < 0 {
+		errs = append(errs, fmt.Errorf("invalid maximum lines %d", b.MaxLines))
+	}
+
+	if b.LineHeight < 0 {
+		errs = append(errs, fmt.Errorf("invalid line height %v", b.LineHeight))
+	}
+
+	if b.ShadowBlur < 0 || b.ShadowBlur > maxShadowBlur {
+		errs = append(errs, fmt.Errorf("invalid shadow blur %v, must be between 0 and %d", b.ShadowBlur, maxShadowBlur))
+	}
+
+	if b.MinSize < 0 || b.MinSize > b.Size {
+		errs = append(errs, fmt.Errorf("minimum size %v out of bounds, must be between 0 and the size %v", b.MinSize, b.Size))
+	}
+
+	if b.MinSize != 0 && b.Width == 0 {
+		errs = append(errs, fmt.Errorf("shrinking texts must have a width to fit"))
+	}
+
+	if b.StrokeWidth < 0 || b.StrokeWidth > maxStrokeWidth {
+		errs = append(errs, fmt.Errorf("invalid stroke width %v, must be between 0 and %d", b.StrokeWidth, maxStrokeWidth))
+	}
+
+	switch b.Direction {
+	case "", directionAuto, directionLTR, directionRTL:
+	default:
+		errs = append(errs, fmt.Errorf("unknown direction %q", b.Direction))
+	}
+
+	return errs
+}
+
+// dimensions returns the dimensions of the images generated with the
+// description: the declared ones if any, those of the base image otherwise.
+func dimensions(desc description) (image.Config, error) {
+	if desc.Width != 0 {
+		return image.Config{Width: desc.Width, Height: desc.Height}, nil
+	}
+	return decodeConfig(desc.Base)
+}
+
+// decodeConfig reads the dimensions of the image at path.
+func decodeConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, wrap(err, "opening base image")
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if errors.Is(err, image.ErrFormat) {
+		return image.Config{}, unsupportedFormat(f, path)
+	}
+	if err != nil {
+		return image.Config{}, wrap(err, "decoding base image %q", path)
+	}
+	return cfg, nil
+}
+
+// descriptionView is the public representation of a description. The path of
+// the base image is replaced by its dimensions, and the coordinates are
+// resolved against them.
+type descriptionView struct {
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	MaxAnswers int     `json:"maxAnswers"`
+	Question   block   `json:"question"`
+	Answers    []block `json:"answers"`
+}
+
+// describe returns the full geometry of a description.
+func (s *service) describe(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("base")
+	desc, ok := s.getDescriptions()[resolveBase(s.getAliases(), name, s.caseSensitiveBases)]
+	if !ok {
+		writeError(rw, http.StatusNotFound, badRequest(codeUnknownBase, fmt.Errorf(`unknown base %q`, name)))
+		return
+	}
+
+	cfg, err := dimensions(desc)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	view := descriptionView{
+		Width:      cfg.Width,
+		Height:     cfg.Height,
+		MaxAnswers: desc.maxAnswers(),
+		Question:   desc.Question.resolved(cfg.Width, cfg.Height),
+		Answers:    make([]block, len(desc.Answers)),
+	}
+	for i, b := range desc.Answers {
+		view.Answers[i] = b.resolved(cfg.Width, cfg.Height)
+	}
+
+	write(rw, http.StatusOK, view)
+}
+
+// baseImage serves the base image of a description, as PNG, for clients
+// drawing over it.
+func (s *service) baseImage(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("base")
+	desc, ok := s.getDescriptions()[resolveBase(s.getAliases(), name, s.caseSensitiveBases)]
+	if !ok {
+		writeError(rw, http.StatusNotFound, badRequest(codeUnknownBase, fmt.Errorf(`unknown base %q`, name)))
+		return
+	}
+
+	if desc.Base == "" {
+		writeError(rw, http.StatusNotFound, fmt.Errorf(`base %q has no image`, name))
+		return
+	}
+
+	img, err := s.baseCache.get(desc.Base)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	var body bytes.Buffer
+	err = encode(&body, "image/png", img, s.pngCompression)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, wrap(err, "encoding image"))
+		return
+	}
+
+	// Bases only change when the service is reconfigured or the
+	// description reloaded.
+	rw.Header().Set("Content-Type", "image/png")
+	rw.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	rw.Header().Set("Cache-Control", "public, max-age=3600")
+	_, _ = body.WriteTo(rw)
+}
+
+// baseView is the summary of a description in the listing of bases.
+type baseView struct {
+	Name       string   `json:"name"`
+	Aliases    []string `json:"aliases,omitempty"`
+	MaxAnswers int      `json:"maxAnswers"`
+}
+
+// bases lists the available descriptions, sorted by name.
+func (s *service) bases(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	descriptions := s.getDescriptions()
+	views := make([]baseView, 0, len(descriptions))
+	for name, desc := range descriptions {
+		views = append(views, baseView{Name: name, Aliases: desc.Aliases, MaxAnswers: desc.maxAnswers()})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Name < views[j].Name
+	})
+
+	write(rw, http.StatusOK, views)
+}
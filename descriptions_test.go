@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPrepareDescriptionBlocks(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		desc  string
+		error string
+	}{
+		{
+			name: "valid",
+			desc: `{"width": 100, "height": 100, "question": {"size": 10, "lineHeight": 1.2, "width": 80, "minSize": 6}, "answers": [{"size": 10}]}`,
+		},
+		{
+			name:  "negative line height",
+			desc:  `{"width": 100, "height": 100, "question": {"size": 10, "lineHeight": -1}, "answers": []}`,
+			error: "question: invalid line height -1",
+		},
+		{
+			name:  "minimum size above the size",
+			desc:  `{"width": 100, "height": 100, "question": {"size": 10}, "answers": [{"size": 10, "width": 80, "minSize": 12}]}`,
+			error: "answer 0: minimum size 12 out of bounds",
+		},
+		{
+			name:  "text layer without size",
+			desc:  `{"width": 100, "height": 100, "question": {"size": 10}, "answers": [], "layers": [{"type": "question"}, {"type": "text", "text": "Bonus"}]}`,
+			error: "layer 1: invalid size 0",
+		},
+		{
+			name:  "static block with unknown direction",
+			desc:  `{"width": 100, "height": 100, "question": {"size": 10}, "answers": [], "static": [{"size": 10, "text": "Bonus", "direction": "up"}]}`,
+			error: `static block 0: unknown direction "up"`,
+		},
+		{
+			name: "question unused by the layers",
+			desc: `{"width": 100, "height": 100, "question": {}, "answers": [], "layers": [{"type": "fill", "color": "#000000"}]}`,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var desc description
+			err := json.Unmarshal([]byte(c.desc), &desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = prepareDescription(desc)
+			if c.error == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.error) {
+				t.Fatalf("expected error %q, got %v", c.error, err)
+			}
+		})
+	}
+}
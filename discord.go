@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// discordTimeout bounds the time spent posting to a Discord webhook.
+const discordTimeout = 10 * time.Second
+
+// discordHosts are the hosts Discord webhooks are served from. Webhooks given
+// by requests are restricted to them, so the service can't be used to post
+// anywhere.
+var discordHosts = []string{"discord.com", "discordapp.com", "ptb.discord.com", "canary.discord.com"}
+
+// discord generates an image and posts it to a Discord webhook, either the
+// one given by the webhook parameter or the one configured by flag.
+func (s *service) discord(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := s.generate(r)
+	if req.err != nil {
+		writeError(rw, status(req.err), req.err)
+		return
+	}
+
+	webhook := r.Form.Get("webhook")
+	if webhook == "" {
+		webhook = s.discordWebhook
+	}
+	if webhook == "" {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidOption, errors.New("no Discord webhook given nor configured")))
+		return
+	}
+	err := checkDiscordWebhook(webhook)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidOption, err))
+		return
+	}
+
+	var image bytes.Buffer
+	err = req.encode(&image, "image/png")
+	req.logTimings()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, wrap(err, "encoding image"))
+		return
+	}
+
+	err = postDiscord(webhook, req.question, image.Bytes())
+	if err != nil {
+		writeError(rw, http.StatusBadGateway, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// checkDiscordWebhook returns an error if the URL isn't a Discord webhook.
+func checkDiscordWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Path, "/api/webhooks/") {
+		return fmt.Errorf(`invalid Discord webhook %q`, webhook)
+	}
+
+	for _, host := range discordHosts {
+		if u.Host == host {
+			return nil
+		}
+	}
+	return fmt.Errorf(`invalid Discord webhook %q`, webhook)
+}
+
+// postDiscord posts the image as an attachment to the webhook. Discord embeds
+// attachments inline when they have an image file name.
+func postDiscord(webhook, content string, image []byte) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	payload, err := json.Marshal(map[string]string{"content": content})
+	if err != nil {
+		return wrap(err, "encoding Discord payload")
+	}
+	err = mw.WriteField("payload_json", string(payload))
+	if err != nil {
+		return wrap(err, "writing Discord payload")
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="files[0]"; filename="votrederniermot.png"`)
+	h.Set("Content-Type", "image/png")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return wrap(err, "writing Discord attachment")
+	}
+	_, err = part.Write(image)
+	if err != nil {
+		return wrap(err, "writing Discord attachment")
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return wrap(err, "writing Discord request")
+	}
+
+	client := http.Client{Timeout: discordTimeout}
+	res, err := client.Post(webhook, mw.FormDataContentType(), &body)
+	if err != nil {
+		return wrap(err, "posting to Discord")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf(`posting to Discord: unexpected status %s`, res.Status)
+	}
+	return nil
+}
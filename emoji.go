@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// emojiFont is a color font, whose glyphs are PNG bitmaps stored in either a
+// sbix (Apple) or a CBDT/CBLC (Google) table. Only the biggest strike of the
+// font is kept, and scaled down to the size of the text.
+type emojiFont struct {
+	// font is used for the character map and the metrics, which are the
+	// same as vector fonts.
+	font *truetype.Font
+
+	// ppem is the size of the strike, in pixels per em.
+	ppem   int
+	glyphs map[truetype.Index]emojiGlyph
+}
+
+// emojiGlyph is the bitmap of a glyph. The bearings are the position of the
+// top-left corner of the bitmap relative to the dot, in pixels of the strike.
+type emojiGlyph struct {
+	data     []byte
+	bearingX int
+	bearingY int
+}
+
+// isEmoji returns whether the character is an emoji, which should be drawn
+// with the emoji font when there is one.
+func isEmoji(c rune) bool {
+	switch {
+	case c >= 0x1F000 && c <= 0x1FAFF: // Pictographs, emoticons, transport, etc.
+		return true
+	case c >= 0x2600 && c <= 0x27BF: // Miscellaneous symbols and dingbats.
+		return true
+	case c >= 0x2300 && c <= 0x23FF: // Miscellaneous technical.
+		return true
+	case c >= 0x2B00 && c <= 0x2BFF: // Miscellaneous symbols and arrows.
+		return true
+	}
+	return false
+}
+
+// isEmojiModifier returns whether the character alters the preceding emoji.
+// Without support for the ligatures of the font, they are ignored.
+func isEmojiModifier(c rune) bool {
+	switch {
+	case c == 0xFE0F, c == 0x200D: // Emoji presentation, zero width joiner.
+		return true
+	case c >= 0x1F3FB && c <= 0x1F3FF: // Skin tones.
+		return true
+	case c >= 0xE0020 && c <= 0xE007F: // Tags.
+		return true
+	}
+	return false
+}
+
+// parseEmojiFont reads and parses the color font at path.
+func parseEmojiFont(path string) (*emojiFont, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, wrap(err, "reading emoji font %q", path)
+	}
+
+	f, err := truetype.Parse(raw)
+	if err != nil {
+		return nil, wrap(err, "parsing emoji font %q", path)
+	}
+
+	tables, err := fontTables(raw)
+	if err != nil {
+		return nil, wrap(err, "parsing emoji font %q", path)
+	}
+
+	e := &emojiFont{font: f}
+	switch {
+	case tables["sbix"] != nil:
+		err = e.parseSbix(tables["sbix"], tables["maxp"])
+	case tables["CBLC"] != nil && tables["CBDT"] != nil:
+		err = e.parseCBDT(tables["CBLC"], tables["CBDT"])
+	default:
+		err = fmt.Errorf("no sbix or CBDT table")
+	}
+	if err != nil {
+		return nil, wrap(err, "parsing emoji font %q", path)
+	}
+	return e, nil
+}
+
+// fontTables returns the tables of the font, keyed by tag.
+func fontTables(raw []byte) (map[string][]byte, error) {
+	if len(raw) < 12 {
+		return nil, fmt.Errorf("font too short")
+	}
+
+	n := int(binary.BigEndian.Uint16(raw[4:]))
+	if len(raw) < 12+16*n {
+		return nil, fmt.Errorf("table directory too short")
+	}
+
+	tables := make(map[string][]byte)
+	for i := 0; i < n; i++ {
+		record := raw[12+16*i:]
+		offset := binary.BigEndian.Uint32(record[8:])
+		length := binary.BigEndian.Uint32(record[12:])
+		if uint64(offset)+uint64(length) > uint64(len(raw)) {
+			return nil, fmt.Errorf("table %q out of bounds", record[:4])
+		}
+		tables[string(record[:4])] = raw[offset : offset+length]
+	}
+	return tables, nil
+}
+
+// parseSbix reads the glyphs of the biggest strike of a sbix table.
+func (e *emojiFont) parseSbix(sbix, maxp []byte) error {
+	if len(sbix) < 8 || len(maxp) < 6 {
+		return fmt.Errorf("sbix table too short")
+	}
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	numStrikes := int(binary.BigEndian.Uint32(sbix[4:]))
+	if len(sbix) < 8+4*numStrikes {
+		return fmt.Errorf("sbix table too short")
+	}
+
+	var strike []byte
+	for i := 0; i < numStrikes; i++ {
+		offset := binary.BigEndian.Uint32(sbix[8+4*i:])
+		if uint64(offset)+4+4*uint64(numGlyphs+1) > uint64(len(sbix)) {
+			return fmt.Errorf("sbix strike out of bounds")
+		}
+		ppem := int(binary.BigEndian.Uint16(sbix[offset:]))
+		if ppem > e.ppem {
+			e.ppem = ppem
+			strike = sbix[offset:]
+		}
+	}
+	if strike == nil {
+		return fmt.Errorf("no sbix strike")
+	}
+
+	e.glyphs = make(map[truetype.Index]emojiGlyph)
+	for i := 0; i < numGlyphs; i++ {
+		start := binary.BigEndian.Uint32(strike[4+4*i:])
+		end := binary.BigEndian.Uint32(strike[8+4*i:])
+		if end <= start+8 || uint64(end) > uint64(len(strike)) {
+			continue
+		}
+		data := strike[start:end]
+
+		// Duplicate glyphs reference the data of another glyph.
+		if string(data[4:8]) == "dupe" && len(data) >= 10 {
+			j := int(binary.BigEndian.Uint16(data[8:]))
+			if j >= numGlyphs {
+				continue
+			}
+			start = binary.BigEndian.Uint32(strike[4+4*j:])
+			end = binary.BigEndian.Uint32(strike[8+4*j:])
+			if end <= start+8 || uint64(end) > uint64(len(strike)) {
+				continue
+			}
+			data = strike[start:end]
+		}
+		if string(data[4:8]) != "png " {
+			continue
+		}
+
+		// The origin is the bottom-left corner of the bitmap, which height
+		// is only known once decoded.
+		config, err := png.DecodeConfig(bytes.NewReader(data[8:]))
+		if err != nil {
+			continue
+		}
+		e.glyphs[truetype.Index(i)] = emojiGlyph{
+			data:     data[8:],
+			bearingX: int(int16(binary.BigEndian.Uint16(data[0:]))),
+			bearingY: int(int16(binary.BigEndian.Uint16(data[2:]))) + config.Height,
+		}
+	}
+	return nil
+}
+
+// parseCBDT reads the glyphs of the biggest strike of a CBLC/CBDT pair of
+// tables. Only the index formats 1, 3 and 4 and the image formats 17 and 18
+// are supported, which are the ones used for PNG bitmaps with metrics.
+func (e *emojiFont) parseCBDT(cblc, cbdt []byte) error {
+	if len(cblc) < 8 {
+		return fmt.Errorf("CBLC table too short")
+	}
+	numSizes := int(binary.BigEndian.Uint32(cblc[4:]))
+	if len(cblc) < 8+48*numSizes {
+		return fmt.Errorf("CBLC table too short")
+	}
+
+	var size []byte
+	for i := 0; i < numSizes; i++ {
+		record := cblc[8+48*i:]
+		ppem := int(record[45])
+		if ppem > e.ppem {
+			e.ppem = ppem
+			size = record
+		}
+	}
+	if size == nil {
+		return fmt.Errorf("no CBLC strike")
+	}
+
+	arrayOffset := binary.BigEndian.Uint32(size[0:])
+	numSubtables := int(binary.BigEndian.Uint32(size[8:]))
+	if uint64(arrayOffset)+8*uint64(numSubtables) > uint64(len(cblc)) {
+		return fmt.Errorf("CBLC subtables out of bounds")
+	}
+	array := cblc[arrayOffset:]
+
+	e.glyphs = make(map[truetype.Index]emojiGlyph)
+	for i := 0; i < numSubtables; i++ {
+		first := int(binary.BigEndian.Uint16(array[8*i:]))
+		last := int(binary.BigEndian.Uint16(array[8*i+2:]))
+		offset := uint64(arrayOffset) + uint64(binary.BigEndian.Uint32(array[8*i+4:]))
+		if offset+8 > uint64(len(cblc)) || last < first {
+			continue
+		}
+		subtable := cblc[offset:]
+		indexFormat := binary.BigEndian.Uint16(subtable[0:])
+		imageFormat := binary.BigEndian.Uint16(subtable[2:])
+		imageOffset := binary.BigEndian.Uint32(subtable[4:])
+		if imageFormat != 17 && imageFormat != 18 {
+			continue
+		}
+
+		// Collect the bounds of the data of each glyph.
+		type location struct {
+			glyph      int
+			start, end uint32
+		}
+		var locations []location
+		switch indexFormat {
+		case 1:
+			if uint64(len(subtable)) < 8+4*uint64(last-first+2) {
+				continue
+			}
+			for g := first; g <= last; g++ {
+				locations = append(locations, location{
+					glyph: g,
+					start: binary.BigEndian.Uint32(subtable[8+4*(g-first):]),
+					end:   binary.BigEndian.Uint32(subtable[12+4*(g-first):]),
+				})
+			}
+		case 3:
+			if uint64(len(subtable)) < 8+2*uint64(last-first+2) {
+				continue
+			}
+			for g := first; g <= last; g++ {
+				locations = append(locations, location{
+					glyph: g,
+					start: uint32(binary.BigEndian.Uint16(subtable[8+2*(g-first):])),
+					end:   uint32(binary.BigEndian.Uint16(subtable[10+2*(g-first):])),
+				})
+			}
+		case 4:
+			if len(subtable) < 12 {
+				continue
+			}
+			n := int(binary.BigEndian.Uint32(subtable[8:]))
+			if uint64(len(subtable)) < 12+4*uint64(n+1) {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				locations = append(locations, location{
+					glyph: int(binary.BigEndian.Uint16(subtable[12+4*j:])),
+					start: uint32(binary.BigEndian.Uint16(subtable[14+4*j:])),
+					end:   uint32(binary.BigEndian.Uint16(subtable[18+4*j:])),
+				})
+			}
+		default:
+			continue
+		}
+
+		for _, l := range locations {
+			start := uint64(imageOffset) + uint64(l.start)
+			end := uint64(imageOffset) + uint64(l.end)
+			if end <= start || end > uint64(len(cbdt)) {
+				continue
+			}
+			data := cbdt[start:end]
+
+			// Both formats start with the bitmap dimensions and bearings,
+			// followed by the other metrics and the length of the PNG.
+			header := 5 + 4
+			if imageFormat == 18 {
+				header = 8 + 4
+			}
+			if len(data) < header {
+				continue
+			}
+			e.glyphs[truetype.Index(l.glyph)] = emojiGlyph{
+				data:     data[header:],
+				bearingX: int(int8(data[2])),
+				bearingY: int(int8(data[3])),
+			}
+		}
+	}
+	return nil
+}
+
+// has returns whether the font has a bitmap for the character.
+func (e *emojiFont) has(c rune) bool {
+	_, ok := e.glyphs[e.font.Index(c)]
+	return ok
+}
+
+// emojiFace is a face of an emoji font at a given size. It measures text like
+// any face, but the bitmaps, being in color, can't be used as masks and must
+// be drawn with its draw method instead of a font.Drawer.
+type emojiFace struct {
+	font    *emojiFont
+	size    float64
+	metrics font.Metrics
+
+	// cache holds the bitmaps already scaled to the size of the face.
+	cache map[truetype.Index]image.Image
+}
+
+// newEmojiFace returns a face of the emoji font with the given size.
+func newEmojiFace(f *emojiFont, size float64) *emojiFace {
+	return &emojiFace{
+		font: f,
+		size: size,
+		metrics: truetype.NewFace(f.font, &truetype.Options{
+			Size: size,
+		}).Metrics(),
+		cache: make(map[truetype.Index]image.Image),
+	}
+}
+
+// scale returns the ratio between the size of the face and the strike.
+func (f *emojiFace) scale() float64 {
+	return f.size / float64(f.font.ppem)
+}
+
+// bitmap returns the bitmap of the glyph at the size of the face, and the
+// position of its top-left corner relative to the dot.
+func (f *emojiFace) bitmap(c rune) (image.Image, image.Point, bool) {
+	i := f.font.font.Index(c)
+	g, ok := f.font.glyphs[i]
+	if !ok {
+		return nil, image.Point{}, false
+	}
+
+	offset := image.Pt(
+		int(float64(g.bearingX)*f.scale()),
+		-int(float64(g.bearingY)*f.scale()),
+	)
+
+	if img, ok := f.cache[i]; ok {
+		return img, offset, true
+	}
+
+	src, err := png.Decode(bytes.NewReader(g.data))
+	if err != nil {
+		return nil, image.Point{}, false
+	}
+	width := int(float64(src.Bounds().Dx())*f.scale() + 0.5)
+	height := int(float64(src.Bounds().Dy())*f.scale() + 0.5)
+	if width < 1 || height < 1 {
+		return nil, image.Point{}, false
+	}
+
+	img := resize(src, width, height)
+	f.cache[i] = img
+	return img, offset, true
+}
+
+// draw the text on the image, advancing the dot.
+func (f *emojiFace) draw(dst draw.Image, dot *fixed.Point26_6, text string, spacing fixed.Int26_6) {
+	for _, c := range text {
+		img, offset, ok := f.bitmap(c)
+		if ok {
+			min := image.Pt(dot.X.Round(), dot.Y.Round()).Add(offset)
+			draw.Draw(dst, img.Bounds().Sub(img.Bounds().Min).Add(min), img, img.Bounds().Min, draw.Over)
+		}
+
+		advance, _ := f.GlyphAdvance(c)
+		dot.X += advance + spacing
+	}
+}
+
+// Close implements font.Face.
+func (f *emojiFace) Close() error {
+	return nil
+}
+
+// Glyph implements font.Face. The bitmap is returned as a mask, losing its
+// colors.
+func (f *emojiFace) Glyph(dot fixed.Point26_6, c rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	advance, _ := f.GlyphAdvance(c)
+
+	img, offset, ok := f.bitmap(c)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, advance, false
+	}
+
+	min := image.Pt(dot.X.Round(), dot.Y.Round()).Add(offset)
+	return img.Bounds().Sub(img.Bounds().Min).Add(min), img, img.Bounds().Min, advance, true
+}
+
+// GlyphBounds implements font.Face.
+func (f *emojiFace) GlyphBounds(c rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	advance, _ := f.GlyphAdvance(c)
+
+	img, offset, ok := f.bitmap(c)
+	if !ok {
+		return fixed.Rectangle26_6{}, advance, false
+	}
+
+	return fixed.R(offset.X, offset.Y, offset.X+img.Bounds().Dx(), offset.Y+img.Bounds().Dy()), advance, true
+}
+
+// GlyphAdvance implements font.Face, using the horizontal metrics of the
+// font.
+func (f *emojiFace) GlyphAdvance(c rune) (fixed.Int26_6, bool) {
+	i := f.font.font.Index(c)
+	return f.font.font.HMetric(fixed.Int26_6(f.size*64), i).AdvanceWidth, i != 0
+}
+
+// Kern implements font.Face. Emoji aren't kerned.
+func (f *emojiFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	return 0
+}
+
+// Metrics implements font.Face.
+func (f *emojiFace) Metrics() font.Metrics {
+	return f.metrics
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// pngCompressions are the PNG compression levels, by name.
+var pngCompressions = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"no":      png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// parsePNGCompression returns the PNG compression level of the given name.
+func parsePNGCompression(name string) (png.CompressionLevel, error) {
+	level, ok := pngCompressions[name]
+	if !ok {
+		return 0, fmt.Errorf(`unknown PNG compression %q, must be one of default, no, speed, best`, name)
+	}
+	return level, nil
+}
+
+// encode the image in the format of the content type, PNG images being
+// compressed at the given level. There is no WebP encoder available in Go, so
+// it can't be offered.
+func encode(w io.Writer, contentType string, img image.Image, level png.CompressionLevel) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	default:
+		enc := png.Encoder{CompressionLevel: level}
+		return enc.Encode(w, img)
+	}
+}
+
+// offers are the content types the service can produce, by order of
+// preference.
+var offers = []string{"image/png", "image/jpeg"}
+
+// extensions are the content types of the offers, by file extension.
+var extensions = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+}
+
+// negotiate returns the offer best matching the Accept header, or an empty
+// string if none is acceptable.
+func negotiate(accept string, offers []string) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := quality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// explicit returns whether the Accept header names the content type, rather
+// than only matching it with a wildcard.
+func explicit(accept string, contentType string) bool {
+	for _, r := range strings.Split(accept, ",") {
+		mediaRange := strings.ToLower(strings.TrimSpace(strings.Split(r, ";")[0]))
+		if mediaRange == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// quality returns the quality value the Accept header gives to the content
+// type, using the most specific media range matching it.
+func quality(accept string, contentType string) float64 {
+	q, specificity := 0.0, -1
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch {
+		case mediaRange == contentType:
+			s = 2
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaRange, "*")):
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, qValue(params[1:])
+	}
+	return q
+}
+
+// qValue returns the quality value among the parameters of an element of an
+// Accept header, 1 if it has none.
+func qValue(params []string) float64 {
+	q := 1.0
+	for _, p := range params {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 || kv[0] != "q" {
+			continue
+		}
+		v, err := strconv.ParseFloat(kv[1], 64)
+		if err == nil {
+			q = v
+		}
+	}
+	return q
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// fontCache holds the parsed fonts, keyed by path. Fonts are parsed on first
+// use, and the least recently used ones are evicted once the cache is full.
+// The default font, keyed by the empty string, is always available.
+type fontCache struct {
+	size int
+	def  *truetype.Font
+
+	mu      sync.Mutex
+	fonts   map[string]*list.Element
+	recency *list.List
+}
+
+// fontEntry is an element of the recency list of the cache.
+type fontEntry struct {
+	path string
+	font *truetype.Font
+}
+
+// newFontCache returns a cache holding at most size fonts besides the default
+// one.
+func newFontCache(size int) (*fontCache, error) {
+	def, err := truetype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, wrap(err, "parsing default font")
+	}
+
+	return &fontCache{
+		size:    size,
+		def:     def,
+		fonts:   make(map[string]*list.Element),
+		recency: list.New(),
+	}, nil
+}
+
+// get returns the font at path, parsing it if it isn't cached.
+func (c *fontCache) get(path string) (*truetype.Font, error) {
+	if path == "" {
+		return c.def, nil
+	}
+
+	c.mu.Lock()
+	e, ok := c.fonts[path]
+	if ok {
+		c.recency.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.Value.(fontEntry).font, nil
+	}
+
+	// Fonts are parsed without holding the lock, so concurrent requests
+	// for the same font may parse it twice.
+	f, err := parseFont(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.fonts[path]; !ok {
+		c.fonts[path] = c.recency.PushFront(fontEntry{path: path, font: f})
+	}
+	for c.recency.Len() > c.size {
+		last := c.recency.Back()
+		c.recency.Remove(last)
+		delete(c.fonts, last.Value.(fontEntry).path)
+	}
+	return f, nil
+}
+
+// checkFonts parses the fonts referenced by the descriptions, so missing or
+// invalid ones are reported at startup.
+func checkFonts(c *fontCache, descriptions map[string]description) error {
+	for _, desc := range descriptions {
+		for _, path := range append([]string{desc.Font}, desc.Fallbacks...) {
+			_, err := c.get(path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseFont reads and parses the TrueType font at path.
+func parseFont(path string) (*truetype.Font, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, wrap(err, "reading font %q", path)
+	}
+
+	f, err := truetype.Parse(raw)
+	if err != nil {
+		return nil, wrap(err, "parsing font %q", path)
+	}
+	return f, nil
+}
+
+// loadFallbacks parses every TrueType font of the directory, in lexical
+// order.
+func loadFallbacks(dir string) ([]*truetype.Font, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ttf"))
+	if err != nil {
+		return nil, wrap(err, "listing fonts directory")
+	}
+
+	var fonts []*truetype.Font
+	for _, path := range paths {
+		f, err := parseFont(path)
+		if err != nil {
+			return nil, err
+		}
+		fonts = append(fonts, f)
+	}
+	return fonts, nil
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/golang/freetype/truetype"
 	"github.com/inconshreveable/log15"
 	"github.com/rs/xid"
 	"golang.org/x/image/font"
-	"golang.org/x/image/font/gofont/goregular"
 	"golang.org/x/image/math/fixed"
 )
 
@@ -20,20 +28,73 @@ type generateRequest struct {
 	r            *http.Request
 	logger       log15.Logger
 	descriptions map[string]description
+	aliases      map[string]string
+	baseCache    *baseCache
+	placeholder  image.Image
+	defaultBase  string
+	maxTextLen   int
+	fonts        *fontCache
+	fallbacks    []*truetype.Font
+	emoji        *emojiFont
 
-	base     string
-	question string
-	answers  []string
+	caseSensitiveBases      bool
+	sanitizeText            bool
+	stripMissingGlyphs      bool
+	missingGlyphReplacement rune
+
+	watermark         image.Image
+	watermarkPosition string
+	watermarkMargin   int
+	watermarkOpacity  float64
+
+	pngCompression png.CompressionLevel
+	colors         int
+
+	payload   payload
+	baseImage image.Image
+	base      string
+	question  string
+	answers   []answer
+	correct   int
+	highlight style
+	sizes     []int
+	scale     float64
+	width     int
+	dpi       float64
+
+	// shuffle asks for the answers to be shuffled, with the seed if seeded,
+	// in the order of the permutation: the ith slot gets the answer at
+	// permutation[i].
+	shuffle     bool
+	seed        int64
+	seeded      bool
+	permutation []int
 
 	uid   string
 	err   error
 	desc  description
 	image *image.RGBA
 	font  *truetype.Font
+	chain []*truetype.Font
+
+	// Errors found resolving the payload, err being the first.
+	errs []error
+
+	// Durations of the stages, as log key-value pairs.
+	timings []interface{}
+
+	// Dimensions of the template, before any DPI scaling.
+	templateWidth  int
+	templateHeight int
 }
 
 func (r *generateRequest) init() {
-	r.uid = xid.New().String()
+	if r.uid == "" {
+		r.uid = requestID(r.r.Context())
+	}
+	if r.uid == "" {
+		r.uid = xid.New().String()
+	}
 	r.logger = r.logger.New("uid", r.uid)
 }
 
@@ -42,95 +103,796 @@ func (r *generateRequest) readPayload() {
 		return
 	}
 
-	r.r.ParseForm()
+	// Besides JSON, payloads are read from form values, whether they come
+	// from the query string or the body of a plain HTML form.
+	var err error
+	switch mediaType(r.r) {
+	case "multipart/form-data":
+		err = r.r.ParseMultipartForm(maxFormMemory)
+	default:
+		err = r.r.ParseForm()
+	}
+	if err != nil {
+		r.err = badRequest(codeInvalidPayload, wrap(err, "parsing form"))
+		return
+	}
+
+	switch mediaType(r.r) {
+	case "application/json":
+		err = read(r.r, &r.payload)
+		if err != nil {
+			r.err = badRequest(codeInvalidPayload, wrap(err, "parsing payload"))
+			return
+		}
+	default:
+		r.payload, err = formPayload(r.r.Form)
+		if err != nil {
+			r.err = badRequest(codeInvalidPayload, err)
+			return
+		}
+	}
+}
+
+// render runs the rendering steps of the pipeline, once the payload is known.
+func (r *generateRequest) render() {
+	r.resolve()
+	r.getBase()
+	r.checkBlocks()
+	r.getFont()
+	r.writeLayers()
+	r.resize()
+	r.drawWatermark()
+}
+
+// resolve the payload against its description, and read the rendering
+// options from the request parameters. The checks that don't depend on each
+// other all run, so that their errors are all kept in errs, the first one
+// stopping the pipeline.
+func (r *generateRequest) resolve() {
+	if r.err != nil {
+		return
+	}
+
+	var errs []error
+	defer func() {
+		if len(errs) != 0 {
+			r.err, r.errs = errs[0], errs
+		}
+	}()
+
+	p := r.payload
+	if r.sanitizeText {
+		p.Question = sanitize(p.Question)
+		for i := range p.Answers.list {
+			p.Answers.list[i].Text = sanitize(p.Answers.list[i].Text)
+		}
+		for k, v := range p.Answers.named {
+			v.Text = sanitize(v.Text)
+			p.Answers.named[k] = v
+		}
+	}
 
-	r.base = r.r.Form.Get("base")
+	r.base = string(p.Base)
 	if r.base == "" {
-		r.base = "qvgdm"
+		r.base = r.defaultBase
+	}
+	r.base = resolveBase(r.aliases, r.base, r.caseSensitiveBases)
+
+	r.question = p.Question
+
+	if len(r.r.Form["sizes"]) > maxSizes {
+		errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`too many sizes requested, at most %d are allowed`, maxSizes)))
+	} else {
+		for _, raw := range r.r.Form["sizes"] {
+			size, err := strconv.Atoi(raw)
+			if err != nil || size <= 0 || size > maxDimension {
+				errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`invalid size %q, must be a width between 1 and %d`, raw, maxDimension)))
+				continue
+			}
+			r.sizes = append(r.sizes, size)
+		}
+	}
+
+	if raw := r.r.Form.Get("scale"); raw != "" {
+		var err error
+		r.scale, err = strconv.ParseFloat(raw, 64)
+		if err != nil || r.scale <= 0 {
+			errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`invalid scale %q, must be a positive number`, raw)))
+			r.scale = 0
+		}
+	}
+
+	if raw := r.r.Form.Get("width"); raw != "" {
+		var err error
+		r.width, err = strconv.Atoi(raw)
+		if err != nil || r.width <= 0 || r.width > maxDimension {
+			errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`invalid width %q, must be between 1 and %d`, raw, maxDimension)))
+			r.width = 0
+		}
+	}
+
+	r.dpi = 1
+	if raw := r.r.Form.Get("dpi"); raw != "" {
+		var err error
+		r.dpi, err = strconv.ParseFloat(raw, 64)
+		if err != nil || r.dpi <= 0 {
+			errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`invalid dpi %q, must be a positive number`, raw)))
+			r.dpi = 1
+		}
+		if r.dpi > maxDPI {
+			r.dpi = maxDPI
+		}
 	}
 
-	r.question = r.r.Form.Get("question")
-	r.answers = r.r.Form["answers"]
+	if raw := r.r.Form.Get("png-level"); raw != "" {
+		var err error
+		r.pngCompression, err = parsePNGCompression(raw)
+		if err != nil {
+			errs = append(errs, badRequest(codeInvalidOption, err))
+		}
+	}
+
+	if raw := r.r.Form.Get("colors"); raw != "" {
+		var err error
+		r.colors, err = strconv.Atoi(raw)
+		if err != nil || r.colors < 2 || r.colors > maxColors {
+			errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`invalid colors %q, must be between 2 and %d`, raw, maxColors)))
+			r.colors = 0
+		}
+	}
+
+	if raw := r.r.Form.Get("shuffle"); raw != "" {
+		var err error
+		r.shuffle, err = strconv.ParseBool(raw)
+		if err != nil {
+			errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`invalid shuffle %q, must be a boolean`, raw)))
+		}
+	}
 
+	if raw := r.r.Form.Get("seed"); raw != "" {
+		var err error
+		r.seed, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`invalid seed %q, must be an integer`, raw)))
+		} else {
+			r.seeded = true
+		}
+	}
+
+	if r.scale != 0 && r.width != 0 {
+		errs = append(errs, badRequest(codeInvalidOption, fmt.Errorf(`scale and width are mutually exclusive`)))
+	}
+
+	// The remaining checks depend on the description.
 	var ok bool
 	r.desc, ok = r.descriptions[r.base]
 	if !ok {
-		r.err = fmt.Errorf(`unknown base %q`, r.base)
+		errs = append(errs, badRequest(codeUnknownBase, fmt.Errorf(`unknown base %q`, r.base)))
+		return
+	}
+
+	if r.colors == 0 {
+		r.colors = r.desc.Colors
+	}
+
+	var err error
+	r.answers, err = p.Answers.resolve(r.desc)
+	if err != nil {
+		errs = append(errs, badRequest(codeInvalidPayload, err))
+	}
+
+	for i, a := range r.answers {
+		err = a.check()
+		if err != nil {
+			errs = append(errs, badRequest(codeInvalidPayload, wrap(err, "answer %d", i)))
+		}
+	}
+
+	r.correct = -1
+	if p.Correct != nil {
+		r.correct = *p.Correct
+		if r.correct < 0 || r.correct >= len(r.desc.Answers) {
+			errs = append(errs, badRequest(codeInvalidPayload, fmt.Errorf(`correct answer %d out of range, must be between 0 and %d`, r.correct, len(r.desc.Answers)-1)))
+			r.correct = -1
+		}
+	}
+
+	if p.Shuffle {
+		r.shuffle = true
+	}
+	if p.Seed != nil && !r.seeded {
+		r.seed, r.seeded = *p.Seed, true
+	}
+	if r.shuffle {
+		// A correct answer that wasn't given highlights a blank slot, which
+		// would be another once shuffled: it highlights none.
+		if r.correct >= len(r.answers) {
+			r.correct = -1
+		}
+		r.shuffleAnswers()
+	}
+
+	// The correct answer stands out in orange unless told otherwise.
+	r.highlight = r.desc.Highlight
+	if r.highlight.Color == "" && r.highlight.Background == "" {
+		r.highlight.Color = defaultHighlight
+	}
+	if p.Highlight != "" {
+		_, err := parseColor(p.Highlight)
+		if err != nil {
+			errs = append(errs, badRequest(codeInvalidPayload, wrap(err, "highlight")))
+		} else {
+			r.highlight.Color = p.Highlight
+		}
+	}
+
+	err = r.checkLength(r.desc.Question, r.question)
+	if err != nil {
+		errs = append(errs, badRequest(codeTextTooLong, wrap(err, "question")))
+	}
+
+	for i := 0; i < len(r.answers) && i < len(r.desc.Answers); i++ {
+		err = r.checkLength(r.answerBlock(i), r.answers[i].Text)
+		if err != nil {
+			errs = append(errs, badRequest(codeTextTooLong, wrap(err, "answer %d", i)))
+		}
+	}
+
+	if len(errs) != 0 {
 		return
 	}
+
+	// Only logged at debug level, as the texts may contain personal data.
+	r.logger.Debug("resolved request", "base", r.base, "question", r.question, "answers", len(r.answers), "texts", strings.Join(r.answerTexts(), " | "), "correct", r.correct)
+}
+
+// shuffleAnswers shuffles the answers, the correct one included. The order
+// only depends on the seed, which defaults to a hash of the texts, so the same
+// request always gives the same image.
+func (r *generateRequest) shuffleAnswers() {
+	seed := r.seed
+	if !r.seeded {
+		h := fnv.New64a()
+		_, _ = io.WriteString(h, r.question)
+		for _, a := range r.answers {
+			_, _ = h.Write([]byte{0})
+			_, _ = io.WriteString(h, a.Text)
+		}
+		seed = int64(h.Sum64())
+	}
+
+	r.permutation = rand.New(rand.NewSource(seed)).Perm(len(r.answers))
+	answers := make([]answer, len(r.answers))
+	correct := -1
+	for i, j := range r.permutation {
+		answers[i] = r.answers[j]
+		if j == r.correct {
+			correct = i
+		}
+	}
+	r.answers = answers
+	r.correct = correct
+}
+
+// order returns the order of the shuffled answers, as the comma-separated
+// indexes of the answers given, slot by slot.
+func (r *generateRequest) order() string {
+	indexes := make([]string, len(r.permutation))
+	for i, j := range r.permutation {
+		indexes[i] = strconv.Itoa(j)
+	}
+	return strings.Join(indexes, ",")
+}
+
+// answerBlock returns the block of the ith answer. Blocks of balanced layouts
+// are laid out for the answers given.
+func (r *generateRequest) answerBlock(i int) block {
+	b := r.desc.Answers[i]
+	if !b.balanced {
+		return b
+	}
+
+	first := len(r.desc.Answers) - r.desc.Balance.Count
+	n := len(r.answers) - first
+	if n > r.desc.Balance.Count {
+		n = r.desc.Balance.Count
+	}
+	if i-first >= n {
+		return b
+	}
+	return r.desc.Balance.cell(i-first, n)
+}
+
+// prefixed returns the text of the answer, with its prefix if it has one and
+// isn't empty.
+func (r *generateRequest) prefixed(i int) string {
+	text := r.answers[i].Text
+	if text == "" || i >= len(r.desc.AnswerPrefixes) {
+		return text
+	}
+	return r.desc.AnswerPrefixes[i] + text
 }
 
-// getBase open and decode the base image, and convert it into a RGBA image
+// answerTexts returns the texts of the answers.
+func (r *generateRequest) answerTexts() []string {
+	texts := make([]string, len(r.answers))
+	for i, a := range r.answers {
+		texts[i] = a.Text
+	}
+	return texts
+}
+
+// checkLength checks the text against the maximum length of its block and the
+// global one. Lengths are counted in runes.
+func (r *generateRequest) checkLength(b block, text string) error {
+	n := utf8.RuneCountInString(text)
+	if b.MaxChars > 0 && n > b.MaxChars {
+		return fmt.Errorf(`text too long, at most %d characters are allowed`, b.MaxChars)
+	}
+	if r.maxTextLen > 0 && n > r.maxTextLen {
+		return fmt.Errorf(`text too long, at most %d characters are allowed`, r.maxTextLen)
+	}
+	return nil
+}
+
+// getBase gets the decoded base image, and convert it into a RGBA image
 // suitable to be modified.
 func (r *generateRequest) getBase() {
 	if r.err != nil {
 		return
 	}
+	defer r.measure("get_base", time.Now())
 
-	f, err := os.Open(r.desc.Base)
-	if err != nil {
-		r.err = wrap(err, "opening base image")
-		return
+	var src image.Image
+	if r.baseImage != nil {
+		src = r.baseImage
+	} else if r.desc.Base != "" {
+		var err error
+		src, err = r.baseCache.get(r.desc.Base)
+		if err != nil && r.placeholder != nil {
+			r.logger.Warn("using placeholder image", "base", r.base, "err", err)
+			src, err = r.placeholder, nil
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
 	}
-	defer f.Close()
 
-	src, _, err := image.Decode(f)
-	if err != nil {
-		r.err = wrap(err, "decoding base image")
-		return
+	// With declared dimensions, the base is drawn on a transparent canvas.
+	if r.desc.Width != 0 {
+		canvas := image.NewRGBA(image.Rect(0, 0, r.desc.Width, r.desc.Height))
+		if src != nil {
+			sb := src.Bounds()
+			draw.Draw(canvas, sb.Sub(sb.Min).Add(image.Pt(r.desc.BaseX, r.desc.BaseY)), src, sb.Min, draw.Over)
+		}
+		src = canvas
 	}
 
 	b := src.Bounds()
+	r.templateWidth, r.templateHeight = b.Dx(), b.Dy()
+
+	// For high DPI rendering, the base is upscaled and the blocks will be
+	// scaled along.
+	if r.dpi != 1 {
+		width, height := int(float64(b.Dx())*r.dpi), int(float64(b.Dy())*r.dpi)
+		if width < 1 || height < 1 || width > maxDimension || height > maxDimension {
+			r.err = badRequest(codeInvalidOption, fmt.Errorf(`invalid dpi %v, the image would be %dx%d, must be between 1 and %d`, r.dpi, width, height, maxDimension))
+			return
+		}
+		src = resize(src, width, height)
+		b = src.Bounds()
+	}
+
+	// The background shows through the transparent parts of the base.
 	r.image = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
-	draw.Draw(r.image, r.image.Bounds(), src, b.Min, draw.Src)
+	op := draw.Src
+	if r.desc.Background != "" {
+		draw.Draw(r.image, r.image.Bounds(), image.NewUniform(parseColorOr(r.desc.Background, color.Transparent)), image.Point{}, draw.Src)
+		op = draw.Over
+	}
+	draw.Draw(r.image, r.image.Bounds(), src, b.Min, op)
+}
+
+// checkBlocks checks the blocks against the dimensions of the image. Blocks
+// outside of it draw nothing, which is a mistake of the description, or the
+// placeholder replacing the base being smaller. It is only logged, as the
+// request isn't at fault.
+func (r *generateRequest) checkBlocks() {
+	if r.err != nil {
+		return
+	}
+
+	cfg := image.Config{Width: r.templateWidth, Height: r.templateHeight}
+	var errs []error
+	for i, l := range r.desc.layers() {
+		switch l.Type {
+		case layerQuestion:
+			errs = append(errs, validateBlock(cfg, r.desc.Question, "question")...)
+		case layerAnswer:
+			errs = append(errs, validateBlock(cfg, r.answerBlock(l.Answer), "answer %d", l.Answer)...)
+		case layerText:
+			errs = append(errs, validateBlock(cfg, l.block, "layer %d", i)...)
+		}
+	}
+
+	for _, err := range errs {
+		r.logger.Warn("checking blocks", "base", r.base, "err", err)
+	}
 }
 
-// Get the font for this image.
+// Get the font for this image. Fonts are cached once parsed, so this is
+// usually only a lookup.
 func (r *generateRequest) getFont() {
 	if r.err != nil {
 		return
 	}
+	defer r.measure("get_font", time.Now())
 
 	var err error
-	r.font, err = truetype.Parse(goregular.TTF)
+	r.font, err = r.fonts.get(r.desc.Font)
 	if err != nil {
-		r.err = wrap(err, "loading font")
+		r.err = err
 		return
 	}
+
+	// The fallback chain starts with the description font, continues with
+	// its own fallbacks, and ends with the global ones.
+	r.chain = append(r.chain, r.font)
+	for _, path := range r.desc.Fallbacks {
+		f, err := r.fonts.get(path)
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.chain = append(r.chain, f)
+	}
+	r.chain = append(r.chain, r.fallbacks...)
 }
 
-func (r *generateRequest) writeQuestion() {
+// resize the image to the requested scale or width, if any. This is done once
+// the text is drawn so it is scaled along the template.
+func (r *generateRequest) resize() {
 	if r.err != nil {
 		return
 	}
+	defer r.measure("resize", time.Now())
 
-	// Draw the question.
-	d := &font.Drawer{
-		Dst: r.image,
-		Src: image.NewUniform(color.White),
-		Face: truetype.NewFace(r.font, &truetype.Options{
-			Size: r.desc.Question.Size,
-		}),
-		Dot: fixed.P(r.desc.Question.X, r.desc.Question.Y),
+	if r.scale == 0 && r.width == 0 {
+		return
 	}
-	d.DrawString(r.question)
+
+	b := r.image.Bounds()
+	width, height := r.width, b.Dy()*r.width/b.Dx()
+	if r.scale != 0 {
+		width, height = int(float64(b.Dx())*r.scale), int(float64(b.Dy())*r.scale)
+	}
+
+	if width < 1 || height < 1 || width > maxDimension || height > maxDimension {
+		r.err = badRequest(codeInvalidOption, fmt.Errorf(`output dimensions %dx%d out of bounds, must be between 1 and %d`, width, height, maxDimension))
+		return
+	}
+
+	r.image = resize(r.image, width, height)
 }
 
-func (r *generateRequest) writeAnswers() {
-	if r.err != nil {
+// drawWatermark draws the watermark in its corner of the final image.
+func (r *generateRequest) drawWatermark() {
+	if r.err != nil || r.watermark == nil {
 		return
 	}
+	defer r.measure("draw_watermark", time.Now())
 
-	// Draw the answers.
-	for i := 0; i < len(r.answers) && i < len(r.desc.Answers); i++ {
-		d := &font.Drawer{
-			Dst: r.image,
-			Src: image.NewUniform(color.White),
-			Face: truetype.NewFace(r.font, &truetype.Options{
-				Size: r.desc.Answers[i].Size,
-			}),
-			Dot: fixed.P(r.desc.Answers[i].X, r.desc.Answers[i].Y),
+	b, wb := r.image.Bounds(), r.watermark.Bounds()
+	x, y := b.Min.X+r.watermarkMargin, b.Min.Y+r.watermarkMargin
+	if strings.HasSuffix(r.watermarkPosition, "right") {
+		x = b.Max.X - r.watermarkMargin - wb.Dx()
+	}
+	if strings.HasPrefix(r.watermarkPosition, "bottom") {
+		y = b.Max.Y - r.watermarkMargin - wb.Dy()
+	}
+
+	mask := image.NewUniform(color.Alpha{A: uint8(r.watermarkOpacity*255 + 0.5)})
+	draw.DrawMask(r.image, wb.Sub(wb.Min).Add(image.Pt(x, y)), r.watermark, wb.Min, mask, image.Point{}, draw.Over)
+}
+
+// encode the image, in the format of the content type. PNG images are
+// reduced to a palette if the request or the description asks for one.
+func (r *generateRequest) encode(w io.Writer, contentType string) error {
+	var img image.Image = r.image
+	if r.colors != 0 && contentType == "image/png" {
+		start := time.Now()
+		img = quantize(r.image, r.colors)
+		r.measure("quantize", start)
+	}
+
+	defer r.measure("encode", time.Now())
+	return encode(w, contentType, img, r.pngCompression)
+}
+
+// measure records the duration of a stage started at the given time.
+func (r *generateRequest) measure(stage string, start time.Time) {
+	r.timings = append(r.timings, stage, time.Since(start))
+	traceStage(r.r.Context(), r.uid, stage, start)
+}
+
+// logTimings logs the durations of the stages the request went through.
+func (r *generateRequest) logTimings() {
+	r.logger.Debug("timings", r.timings...)
+}
+
+// drawText draws the text on the image according to the block. Each line of
+// the text is drawn below the previous one.
+func (r *generateRequest) drawText(b block, text string) {
+	// Empty texts, like absent answers, leave their block blank, box
+	// included.
+	if text == "" {
+		return
+	}
+
+	b = r.inset(b)
+	b.Size *= r.dpi
+	if b.MinSize != 0 && b.Width != 0 {
+		b.Size = r.fitSize(b, text)
+	}
+	lines, metrics := r.layout(b, text)
+
+	if b.Background != "" {
+		r.drawBackground(b, lines, metrics)
+	}
+
+	if b.ShadowColor != "" {
+		r.drawShadow(b, lines)
+	}
+
+	if b.StrokeWidth != 0 {
+		r.drawStroke(b, lines)
+	}
+	if b.Hollow {
+		return
+	}
+
+	// Gradients are relative to the text, so the text is drawn as a mask
+	// first, through which the gradient is then drawn. They can't be the
+	// source of the drawer directly, as it aligns the source with each
+	// glyph instead of the image.
+	var dst draw.Image = r.image
+	var src image.Image = image.NewUniform(fade(parseColorOr(b.Color, color.White), b.opacity()))
+	var mask *image.Alpha
+	if b.Gradient != nil {
+		mask = image.NewAlpha(r.image.Bounds())
+		dst = mask
+		src = image.Opaque
+	}
+
+	drawLines(dst, src, lines, fixed.Point26_6{})
+
+	if mask != nil {
+		if o := b.opacity(); o < 1 {
+			for i := range mask.Pix {
+				mask.Pix[i] = uint8(float64(mask.Pix[i])*o + 0.5)
+			}
+		}
+		g := b.Gradient.image(textBox(lines, metrics), r.image.Bounds())
+		draw.DrawMask(r.image, r.image.Bounds(), g, image.Point{}, mask, image.Point{}, draw.Over)
+	}
+}
+
+// drawLines draws the runs of the lines, moved by the offset.
+func drawLines(dst draw.Image, src image.Image, lines []textLine, offset fixed.Point26_6) {
+	for _, l := range lines {
+		dot := l.dot.Add(offset)
+		for _, run := range l.runs {
+			d := &font.Drawer{
+				Dst:  dst,
+				Src:  src,
+				Face: run.face,
+				Dot:  dot,
+			}
+			run.draw(d)
+			dot = d.Dot
+		}
+	}
+}
+
+// inset moves the block inside the safe area of the description, and limits
+// its width to the edge of the area. The coordinates of the returned block are
+// absolute.
+func (r *generateRequest) inset(b block) block {
+	a := r.desc.SafeArea
+	if a == (insets{}) {
+		return b
+	}
+
+	b = b.resolved(r.templateWidth, r.templateHeight)
+	b.X.value = math.Max(a.Left, math.Min(float64(r.templateWidth)-a.Right, b.X.value))
+	// Ordinates are those of the baseline, the text rising about its size
+	// above it.
+	b.Y.value = math.Max(a.Top+b.Size, math.Min(float64(r.templateHeight)-a.Bottom, b.Y.value))
+
+	available := float64(r.templateWidth) - a.Right - b.X.value
+	if b.Centered {
+		available = float64(r.templateWidth) - a.Right - a.Left
+	}
+	if b.Width == 0 || b.Width > available {
+		b.Width = math.Max(1, available)
+	}
+	return b
+}
+
+// layout splits the text in lines, and computes where each of them starts.
+// It also returns the metrics of the main font at the size of the block.
+func (r *generateRequest) layout(b block, text string) ([]textLine, font.Metrics) {
+	// Coordinates are resolved in the template space, then scaled for DPI.
+	dot := fixed.P(
+		int(float64(b.X.resolve(r.templateWidth))*r.dpi),
+		int(float64(b.Y.resolve(r.templateHeight))*r.dpi),
+	)
+
+	metrics := truetype.NewFace(r.font, &truetype.Options{
+		Size: b.Size,
+	}).Metrics()
+
+	var lines []textLine
+	for _, text := range r.wrap(b, text) {
+		l := textLine{
+			runs: r.splitRuns(b, visualOrder(text, b.Direction)),
+			dot:  dot,
+		}
+		l.width = measureRuns(l.runs)
+
+		// Centered text ignores the configured abscissa and is placed in
+		// the middle of the safe area, the whole image by default, instead.
+		if b.Centered {
+			a := r.desc.SafeArea
+			left := fixed.Int26_6(a.Left * r.dpi * 64)
+			width := fixed.I(r.image.Bounds().Dx()) - left - fixed.Int26_6(a.Right*r.dpi*64)
+			l.dot.X = left + (width-l.width)/2
+		}
+
+		lines = append(lines, l)
+		dot.Y += fixed.Int26_6(float64(metrics.Height) * b.lineHeight())
+	}
+	return lines, metrics
+}
+
+// wrap splits the text in lines: at line breaks, and between words to fit
+// the width of the block if it has one. Lines beyond the maximum of the block
+// are dropped, the last one kept ending with an ellipsis.
+func (r *generateRequest) wrap(b block, text string) []string {
+	width := fixed.Int26_6(b.Width * r.dpi * 64)
+
+	var lines []string
+	for _, paragraph := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		if width == 0 {
+			lines = append(lines, paragraph)
+			continue
+		}
+
+		// Words wider than the block are left overflowing on their own
+		// line.
+		var line string
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && r.textWidth(b, candidate) > width {
+				lines = append(lines, line)
+				candidate = word
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+
+	if b.MaxLines == 0 || len(lines) <= b.MaxLines {
+		return lines
+	}
+
+	lines = lines[:b.MaxLines]
+	last := []rune(strings.TrimRightFunc(lines[len(lines)-1], unicode.IsSpace))
+	for width != 0 && len(last) != 0 && r.textWidth(b, string(last)+ellipsis) > width {
+		last = []rune(strings.TrimRightFunc(string(last[:len(last)-1]), unicode.IsSpace))
+	}
+	lines[len(lines)-1] = string(last) + ellipsis
+	return lines
+}
+
+// fitSize returns the largest size, from the size of the block down to its
+// minimum size by steps of a pixel, at which the text fits the block: its
+// lines are narrower than the block, and no more than its maximum. Each block
+// is sized on its own, so a long answer doesn't shrink the others.
+func (r *generateRequest) fitSize(b block, text string) float64 {
+	min := b.MinSize * r.dpi
+	for ; b.Size > min; b.Size -= r.dpi {
+		if r.fits(b, text) {
+			return b.Size
+		}
+	}
+	return min
+}
+
+// fits returns whether the text fits the block at its size.
+func (r *generateRequest) fits(b block, text string) bool {
+	maxLines := b.MaxLines
+	b.MaxLines = 0
+	lines := r.wrap(b, text)
+	if maxLines != 0 && len(lines) > maxLines {
+		return false
+	}
+
+	width := fixed.Int26_6(b.Width * r.dpi * 64)
+	for _, l := range lines {
+		if r.textWidth(b, l) > width {
+			return false
+		}
+	}
+	return true
+}
+
+// textWidth returns the width of the text once drawn with the block.
+func (r *generateRequest) textWidth(b block, text string) fixed.Int26_6 {
+	return measureRuns(r.splitRuns(b, text))
+}
+
+// drawBackground fills the box around the lines with the background color of
+// the block.
+func (r *generateRequest) drawBackground(b block, lines []textLine, metrics font.Metrics) {
+	padding := int(b.Size / 4)
+	box := textBox(lines, metrics).Inset(-padding)
+
+	draw.Draw(r.image, box, image.NewUniform(parseColorOr(b.Background, color.Transparent)), image.Point{}, draw.Over)
+}
+
+// splitRuns splits the text into runs of runes drawn with the same font. Each
+// rune is drawn with the first font of the chain having a glyph for it. Runes no
+// font has a glyph for are replaced or removed if configured to.
+func (r *generateRequest) splitRuns(b block, text string) []textRun {
+	faces := make([]font.Face, len(r.chain))
+	spacing := fixed.Int26_6(b.LetterSpacing * r.dpi * 64)
+
+	var emoji font.Face
+	if r.emoji != nil {
+		emoji = newEmojiFace(r.emoji, b.Size)
+	}
+
+	var runs []textRun
+	for _, c := range text {
+		// Emoji are drawn from the emoji font when it has them, and their
+		// modifiers are dropped.
+		if emoji != nil && len(runs) != 0 && runs[len(runs)-1].face == emoji && isEmojiModifier(c) {
+			continue
+		}
+		if emoji != nil && isEmoji(c) && r.emoji.has(c) {
+			if len(runs) != 0 && runs[len(runs)-1].face == emoji {
+				runs[len(runs)-1].text += string(c)
+				continue
+			}
+			runs = append(runs, textRun{face: emoji, text: string(c), spacing: spacing})
+			continue
+		}
+
+		i, ok := glyphFont(r.chain, c)
+		if !ok && r.stripMissingGlyphs {
+			if r.missingGlyphReplacement == 0 {
+				continue
+			}
+			c = r.missingGlyphReplacement
+			i, _ = glyphFont(r.chain, c)
+		}
+
+		if faces[i] == nil {
+			faces[i] = newStyledFace(truetype.NewFace(r.chain[i], &truetype.Options{
+				Size: b.Size,
+			}), b)
+		}
+
+		if len(runs) != 0 && runs[len(runs)-1].face == faces[i] {
+			runs[len(runs)-1].text += string(c)
+			continue
 		}
-		d.DrawString(r.answers[i])
+		runs = append(runs, textRun{face: faces[i], text: string(c), spacing: spacing})
 	}
+	return runs
 }
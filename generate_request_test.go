@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// generate renders the payload on the test service, with the query string as
+// options.
+func generate(t *testing.T, s *service, query string, p payload) *generateRequest {
+	t.Helper()
+
+	req := s.newGenerateRequest(httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+	req.init()
+	err := req.r.ParseForm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.payload = p
+	req.render()
+	return req
+}
+
+func TestDPI(t *testing.T) {
+	s := newTestService(t)
+	large := newTestDescription(t)
+	large.Width, large.Height = 2048, 1024
+	s.descriptions["large"] = large
+
+	for _, c := range []struct {
+		name   string
+		base   string
+		dpi    string
+		status int
+		width  int
+	}{
+		{name: "native", base: "test", dpi: "1", width: 400},
+		{name: "double", base: "test", dpi: "2", width: 800},
+		{name: "clamped", base: "test", dpi: "10", width: 1600},
+		{name: "too large", base: "large", dpi: "4", status: http.StatusBadRequest},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := generate(t, s, "dpi="+c.dpi, payload{Base: baseName(c.base), Question: "Question ?"})
+			if c.status != 0 {
+				if req.err == nil || status(req.err) != c.status {
+					t.Fatalf("expected status %d, got %v", c.status, req.err)
+				}
+				return
+			}
+
+			if req.err != nil {
+				t.Fatalf("unexpected error: %s", req.err)
+			}
+			if w := req.image.Bounds().Dx(); w != c.width {
+				t.Errorf("expected width %d, got %d", c.width, w)
+			}
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	s := newTestService(t)
+
+	for _, c := range []struct {
+		name   string
+		query  string
+		status int
+		width  int
+		height int
+	}{
+		{name: "scale", query: "scale=0.5", width: 200, height: 150},
+		{name: "width", query: "width=200", width: 200, height: 150},
+		{name: "zero height", query: "width=1", status: http.StatusBadRequest},
+		{name: "zero scale", query: "scale=0.001", status: http.StatusBadRequest},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := generate(t, s, c.query, payload{Question: "Question ?"})
+			if c.status != 0 {
+				if req.err == nil || status(req.err) != c.status || errorCode(c.status, req.err) != codeInvalidOption {
+					t.Fatalf("expected status %d with code %q, got %v", c.status, codeInvalidOption, req.err)
+				}
+				return
+			}
+
+			if req.err != nil {
+				t.Fatalf("unexpected error: %s", req.err)
+			}
+			if b := req.image.Bounds(); b.Dx() != c.width || b.Dy() != c.height {
+				t.Errorf("expected %dx%d, got %dx%d", c.width, c.height, b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestWriteSizesHeight(t *testing.T) {
+	s := newTestService(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/?sizes=1", strings.NewReader(`{"question": "Question ?"}`))
+	r.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+	s.root(rw, r, nil)
+
+	if rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), codeInvalidOption) {
+		t.Errorf("expected status %d with code %q, got %d: %s", http.StatusBadRequest, codeInvalidOption, rw.Code, rw.Body)
+	}
+}
+
+func TestLayerTimings(t *testing.T) {
+	s := newTestService(t)
+	req := generate(t, s, "", payload{Question: "Question ?", Answers: answers{list: []answer{{Text: "Oui"}, {Text: "Non"}}}})
+	if req.err != nil {
+		t.Fatal(req.err)
+	}
+
+	stages := make(map[interface{}]bool)
+	for i := 0; i < len(req.timings); i += 2 {
+		stages[req.timings[i]] = true
+	}
+	for _, stage := range []string{"write_question", "write_answers"} {
+		if !stages[stage] {
+			t.Errorf("expected a %s timing, got %v", stage, req.timings)
+		}
+	}
+}
+
+func TestShuffleCorrect(t *testing.T) {
+	s := newTestService(t)
+	texts := []string{"Paris", "Lyon", "Marseille"}
+
+	for _, c := range []struct {
+		name    string
+		correct int
+		text    string
+	}{
+		{name: "given", correct: 1, text: "Lyon"},
+		{name: "blank", correct: 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p := payload{Question: "Quelle est la capitale ?", Shuffle: true}
+			for _, text := range texts {
+				p.Answers.list = append(p.Answers.list, answer{Text: text})
+			}
+			correct := c.correct
+			p.Correct = &correct
+
+			req := generate(t, s, "seed=42", p)
+			if req.err != nil {
+				t.Fatal(req.err)
+			}
+
+			if c.text == "" {
+				if req.correct != -1 {
+					t.Errorf("expected no correct answer, got slot %d", req.correct)
+				}
+				return
+			}
+			if req.correct < 0 || req.answers[req.correct].Text != c.text {
+				t.Errorf("expected %q in the correct slot %d, got answers %v", c.text, req.correct, req.answers)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	s := newTestService(t)
+	req := generate(t, s, "", payload{Question: "Question ?"})
+	if req.err != nil {
+		t.Fatal(req.err)
+	}
+
+	b := block{Size: 20, Width: 100}
+	lines := req.wrap(b, "Quelle est la capitale de la France ?")
+	if len(lines) < 2 {
+		t.Fatalf("expected the text to be wrapped, got %q", lines)
+	}
+	for _, l := range lines {
+		if w := req.textWidth(b, l); w > fixed.I(100) {
+			t.Errorf("line %q is %v wide, more than the width of the block", l, w)
+		}
+	}
+	if got := strings.Join(lines, " "); got != "Quelle est la capitale de la France ?" {
+		t.Errorf("expected the wrapped lines to keep all the words, got %q", got)
+	}
+}
+
+func TestLayoutLineBreaks(t *testing.T) {
+	s := newTestService(t)
+	req := generate(t, s, "", payload{Question: "Première ligne\nDeuxième ligne"})
+	if req.err != nil {
+		t.Fatal(req.err)
+	}
+
+	lines, metrics := req.layout(req.desc.Question, req.question)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if lines[0].dot.X != lines[1].dot.X {
+		t.Errorf("expected the lines to start at the same abscissa, got %v and %v", lines[0].dot.X, lines[1].dot.X)
+	}
+	if advance := lines[1].dot.Y - lines[0].dot.Y; advance != metrics.Height {
+		t.Errorf("expected the second line %v below the first, got %v", metrics.Height, advance)
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	s := newTestService(t)
+	req := generate(t, s, "", payload{Question: "Question ?"})
+	if req.err != nil {
+		t.Fatal(req.err)
+	}
+
+	// Sizes are expected between min and max, included.
+	b := block{Size: 20, MinSize: 8, Width: 200, MaxLines: 1}
+	for _, c := range []struct {
+		name string
+		text string
+		min  float64
+		max  float64
+	}{
+		{name: "short", text: "Paris", min: 20, max: 20},
+		{name: "long", text: "Une réponse un peu trop longue", min: 9, max: 19},
+		{name: "too long", text: "Une réponse bien trop longue pour tenir sur une seule ligne, même en tout petit", min: 8, max: 8},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			size := req.fitSize(b, c.text)
+			if size < c.min || size > c.max {
+				t.Errorf("expected a size between %v and %v, got %v", c.min, c.max, size)
+			}
+			if size > b.MinSize {
+				shrunk := b
+				shrunk.Size = size
+				if !req.fits(shrunk, c.text) {
+					t.Errorf("text doesn't fit at size %v", size)
+				}
+			}
+		})
+	}
+}
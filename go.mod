@@ -16,5 +16,8 @@ require (
 	github.com/rs/xid v1.2.1
 	github.com/rs/zerolog v1.19.0
 	github.com/urfave/negroni v1.0.0
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
 	golang.org/x/image v0.0.0-20200430140353-33d19683fad8
+	golang.org/x/text v0.3.2
 )
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// grid lays the answers out in cells of the same size, row by row, so
+// symmetrical templates don't have to position each answer block.
+//
+// The first cell has its top left corner at X, Y, and cells follow each other
+// without gap. Texts start at the top left of their cell, inside the padding,
+// are drawn with the style of the block, and are wrapped at the width of the
+// cell.
+type grid struct {
+	Columns int     `json:"columns"`
+	Rows    int     `json:"rows"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Width   float64 `json:"width"`
+	Height  float64 `json:"height"`
+	Padding float64 `json:"padding,omitempty"`
+	Block   block   `json:"block"`
+}
+
+// check returns an error if the grid is invalid.
+func (g grid) check() error {
+	if g.Columns <= 0 || g.Rows <= 0 {
+		return fmt.Errorf("grid of %dx%d cells, must have at least one column and one row", g.Columns, g.Rows)
+	}
+	if g.Width <= 0 || g.Height <= 0 {
+		return fmt.Errorf("grid cells of %vx%v, must have a positive size", g.Width, g.Height)
+	}
+	if g.Padding < 0 || 2*g.Padding >= math.Min(g.Width, g.Height) {
+		return fmt.Errorf("grid padding %v out of bounds, must leave room in the cells", g.Padding)
+	}
+	return nil
+}
+
+// cell returns the block of the ith cell.
+func (g grid) cell(i int) block {
+	col, row := i%g.Columns, i/g.Columns
+
+	b := g.Block
+	b.X = coordinate{value: g.X + float64(col)*g.Width + g.Padding}
+	b.Y = coordinate{value: g.Y + float64(row)*g.Height + g.Padding + b.Size}
+	b.Width = g.Width - 2*g.Padding
+	b.Centered = false
+	b.Name = ""
+	return b
+}
+
+// withGrid returns the description with an answer block for each cell of its
+// grid, if it has one. Answer blocks already declared, that is having a size,
+// are kept in place of their cell.
+func (d description) withGrid() (description, error) {
+	if d.Grid == nil {
+		return d, nil
+	}
+
+	err := d.Grid.check()
+	if err != nil {
+		return d, err
+	}
+
+	n := d.Grid.Columns * d.Grid.Rows
+	if len(d.Answers) > n {
+		return d, fmt.Errorf("%d answer blocks for a grid of %d cells", len(d.Answers), n)
+	}
+
+	answers := make([]block, n)
+	for i := range answers {
+		answers[i] = d.Grid.cell(i)
+		if i < len(d.Answers) && d.Answers[i].Size != 0 {
+			answers[i] = d.Answers[i]
+		}
+	}
+	d.Answers = answers
+	return d, nil
+}
+
+// balance lays the answers out in columns of a region, spread evenly
+// according to the number of answers given: the columns are filled in turn,
+// their rows sharing the height of the region.
+//
+// Count answer blocks are added to the description, styled as the block,
+// besides the ones it declares. Texts start at the top left of their row, and
+// are wrapped at the width of the column unless the block has a width.
+type balance struct {
+	Columns int     `json:"columns"`
+	Count   int     `json:"count"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Width   float64 `json:"width"`
+	Height  float64 `json:"height"`
+	Block   block   `json:"block"`
+}
+
+// check returns an error if the balanced layout is invalid.
+func (l balance) check() error {
+	if l.Columns <= 0 || l.Count <= 0 {
+		return fmt.Errorf("balanced layout of %d answers in %d columns, must have at least one of each", l.Count, l.Columns)
+	}
+	if l.Width <= 0 || l.Height <= 0 {
+		return fmt.Errorf("balanced layout of %vx%v, must have a positive size", l.Width, l.Height)
+	}
+	return nil
+}
+
+// cell returns the block of the ith answer out of n.
+func (l balance) cell(i, n int) block {
+	columns := l.Columns
+	if columns > n {
+		columns = n
+	}
+	rows := (n + columns - 1) / columns
+	width, height := l.Width/float64(columns), l.Height/float64(rows)
+
+	b := l.Block
+	b.X = coordinate{value: l.X + float64(i/rows)*width}
+	b.Y = coordinate{value: l.Y + float64(i%rows)*height + b.Size}
+	if b.Width == 0 {
+		b.Width = width
+	}
+	b.Centered = false
+	b.Name = ""
+	b.balanced = true
+	return b
+}
+
+// withBalance returns the description with the answer blocks of its balanced
+// layout, if it has one, laid out for all their answers.
+func (d description) withBalance() (description, error) {
+	if d.Balance == nil {
+		return d, nil
+	}
+	if d.Grid != nil {
+		return d, fmt.Errorf("grid and balanced layouts are mutually exclusive")
+	}
+
+	err := d.Balance.check()
+	if err != nil {
+		return d, err
+	}
+
+	answers := make([]block, 0, len(d.Answers)+d.Balance.Count)
+	answers = append(answers, d.Answers...)
+	for i := 0; i < d.Balance.Count; i++ {
+		answers = append(answers, d.Balance.cell(i, d.Balance.Count))
+	}
+	d.Answers = answers
+	return d, nil
+}
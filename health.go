@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// probes are the paths of the health endpoints, whose requests are only
+// logged at debug level as orchestrators call them continuously.
+var probes = map[string]bool{
+	"/healthz": true,
+	"/livez":   true,
+	"/readyz":  true,
+}
+
+// healthResponse is returned by the health endpoints.
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+// livez reports that the process is up.
+func (s *service) livez(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	write(rw, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// readyz reports whether the service can generate images: descriptions are
+// loaded and the base of the default one can be decoded. The base is cached
+// once decoded, so this stays cheap.
+func (s *service) readyz(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	err := s.ready()
+	if err != nil {
+		writeError(rw, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	write(rw, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// ready returns why the service can't generate images, if it can't.
+func (s *service) ready() error {
+	descriptions := s.getDescriptions()
+	if len(descriptions) == 0 {
+		return errors.New("no description loaded")
+	}
+
+	desc := descriptions[resolveBase(s.getAliases(), s.defaultBase, s.caseSensitiveBases)]
+	if desc.Base == "" {
+		return nil
+	}
+
+	_, err := s.baseCache.get(desc.Base)
+	return err
+}
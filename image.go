@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	// maxDimension is the maximum width or height of an output image.
+	maxDimension = 4096
+
+	// maxSizes is the maximum number of sizes that can be requested at once.
+	maxSizes = 8
+
+	// maxDPI is the maximum DPI scaling factor.
+	maxDPI = 4
+)
+
+// parseColor parses an hexadecimal color, in the #rgb, #rrggbb or #rrggbbaa
+// forms.
+func parseColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 8 {
+		return nil, fmt.Errorf(`invalid color %q, must be #rgb, #rrggbb or #rrggbbaa`, s)
+	}
+
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// parseColorOr parses a color, returning the default one if it is empty or
+// invalid. Colors of the descriptions are checked when loading them.
+func parseColorOr(s string, def color.Color) color.Color {
+	if s == "" {
+		return def
+	}
+
+	c, err := parseColor(s)
+	if err != nil {
+		return def
+	}
+	return c
+}
+
+// fade returns the color with its alpha scaled by the opacity.
+func fade(c color.Color, opacity float64) color.Color {
+	if opacity >= 1 {
+		return c
+	}
+
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	n.A = uint8(float64(n.A)*opacity + 0.5)
+	return n
+}
+
+// gradient is a linear gradient between two colors, across the text either
+// from top to bottom or from left to right.
+type gradient struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Direction string `json:"direction"`
+}
+
+// Directions of gradients.
+const (
+	gradientVertical   = "vertical"
+	gradientHorizontal = "horizontal"
+)
+
+// check returns an error if the gradient is invalid.
+func (g gradient) check() error {
+	switch g.Direction {
+	case "", gradientVertical, gradientHorizontal:
+	default:
+		return fmt.Errorf(`invalid gradient direction %q, must be vertical or horizontal`, g.Direction)
+	}
+
+	_, err := parseColor(g.From)
+	if err != nil {
+		return err
+	}
+	_, err = parseColor(g.To)
+	return err
+}
+
+// image returns the gradient going across the box, for an image with the
+// given bounds.
+func (g gradient) image(box, bounds image.Rectangle) image.Image {
+	return gradientImage{
+		from:       color.NRGBAModel.Convert(parseColorOr(g.From, color.White)).(color.NRGBA),
+		to:         color.NRGBAModel.Convert(parseColorOr(g.To, color.White)).(color.NRGBA),
+		horizontal: g.Direction == gradientHorizontal,
+		box:        box,
+		bounds:     bounds,
+	}
+}
+
+// gradientImage is an image of a gradient, the colors before and after the box
+// being those of its edges.
+type gradientImage struct {
+	from, to   color.NRGBA
+	horizontal bool
+	box        image.Rectangle
+	bounds     image.Rectangle
+}
+
+func (g gradientImage) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (g gradientImage) Bounds() image.Rectangle {
+	return g.bounds
+}
+
+func (g gradientImage) At(x, y int) color.Color {
+	pos, start, length := y, g.box.Min.Y, g.box.Dy()
+	if g.horizontal {
+		pos, start, length = x, g.box.Min.X, g.box.Dx()
+	}
+
+	t := 0.0
+	if length > 0 {
+		t = math.Max(0, math.Min(1, float64(pos-start)/float64(length)))
+	}
+
+	lerp := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5)
+	}
+	return color.NRGBA{
+		R: lerp(g.from.R, g.to.R),
+		G: lerp(g.from.G, g.to.G),
+		B: lerp(g.from.B, g.to.B),
+		A: lerp(g.from.A, g.to.A),
+	}
+}
+
+// readImage opens and decodes the image at path.
+func readImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, wrap(err, "opening image")
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, unsupportedFormat(f, path)
+	}
+	if err != nil {
+		return nil, wrap(err, "decoding image %q", path)
+	}
+	return img, nil
+}
+
+// decodeImage decodes an image sent or linked by a client, named for errors.
+// Its dimensions are read first, and images of more than maxPixels pixels are
+// rejected before being decoded, so they can't exhaust the memory. A maxPixels
+// of 0 disables the check.
+func decodeImage(r io.ReadSeeker, name string, maxPixels int) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, badRequest(codeInvalidPayload, unsupportedFormat(r, name))
+	}
+	if err != nil {
+		return nil, badRequest(codeInvalidPayload, wrap(err, "decoding image %q", name))
+	}
+
+	if maxPixels > 0 && cfg.Width*cfg.Height > maxPixels {
+		return nil, badRequest(codeImageTooLarge, fmt.Errorf(`image %q is %dx%d, more than the %d pixels allowed`, name, cfg.Width, cfg.Height, maxPixels))
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, wrap(err, "rewinding image %q", name)
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, badRequest(codeInvalidPayload, wrap(err, "decoding image %q", name))
+	}
+	return img, nil
+}
+
+// supportedFormats lists the formats images can be decoded from, for error
+// messages.
+const supportedFormats = "PNG, JPEG, GIF or WebP"
+
+// unsupportedFormat returns an error naming the format of the image file,
+// sniffed from its first bytes, as the image package doesn't.
+func unsupportedFormat(f io.ReadSeeker, path string) error {
+	format := "unknown"
+
+	head := make([]byte, 512)
+	_, err := f.Seek(0, io.SeekStart)
+	if err == nil {
+		n, _ := io.ReadFull(f, head)
+		format = http.DetectContentType(head[:n])
+	}
+
+	return fmt.Errorf(`image %q has unsupported format %s, must be %s`, path, format, supportedFormats)
+}
+
+// resize scales the image to the given dimensions.
+func resize(src image.Image, width, height int) *image.RGBA {
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+	return dst
+}
+
+// dataURI encodes the image as a PNG data URI.
+func dataURI(img image.Image, level png.CompressionLevel) (string, error) {
+	var buf bytes.Buffer
+	err := encode(&buf, "image/png", img, level)
+	if err != nil {
+		return "", wrap(err, "encoding image")
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
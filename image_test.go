@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func TestDecodeImageMaxPixels(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 100, 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name      string
+		maxPixels int
+		status    int
+	}{
+		{name: "unlimited", maxPixels: 0},
+		{name: "within", maxPixels: 5000},
+		{name: "over", maxPixels: 4999, status: http.StatusBadRequest},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := decodeImage(bytes.NewReader(buf.Bytes()), "test", c.maxPixels)
+			if c.status == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || status(err) != c.status || errorCode(status(err), err) != codeImageTooLarge {
+				t.Fatalf("expected an %s error, got %v", codeImageTooLarge, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// inlineName is the name inline descriptions are rendered under.
+const inlineName = "inline"
+
+// inlineTimeout bounds the time spent fetching the base of an inline
+// description.
+const inlineTimeout = 10 * time.Second
+
+// maxInlineBase is the maximum size in bytes of the bases fetched for inline
+// descriptions.
+const maxInlineBase = 10 << 20
+
+// maxInlineRedirects is the maximum number of redirects followed when
+// fetching the base of an inline description.
+const maxInlineRedirects = 3
+
+// inlineClient fetches the bases of inline descriptions.
+var inlineClient = newInlineClient(false)
+
+// errPrivateAddress is returned when fetching a base from an address of the
+// network of the service.
+var errPrivateAddress = errors.New("base must be on a public address")
+
+// privateNetworks are the networks bases can't be fetched from, beside
+// loopback, link-local and unspecified addresses.
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+// newInlineClient returns a client for the bases of inline descriptions. It
+// has its own timeout, so that a stalled server can't hold a render, and only
+// follows a few redirects, to HTTP URLs. Unless allowPrivate is set, it
+// refuses to connect to private addresses, so that clients can't reach the
+// network of the service. The check is done on the resolved address, and
+// proxies are ignored, so that it can't be bypassed.
+func newInlineClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   inlineTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if isPrivate(net.ParseIP(host)) {
+				return wrap(errPrivateAddress, "address %s", host)
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   inlineTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxInlineRedirects {
+				return fmt.Errorf(`stopped after %d redirects`, maxInlineRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf(`redirected to unsupported scheme %q`, req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// isPrivate returns whether the address is private, or can't be parsed.
+func isPrivate(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mustParseCIDR parses a network, and panics if it is invalid.
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// inlineRequest is the payload of /render-inline: a description, and the texts
+// to render with it.
+type inlineRequest struct {
+	Description description `json:"description"`
+	payload
+}
+
+// renderInlineDescription renders a description sent along with the texts,
+// without registering it, to prototype templates. Its base is either a URL,
+// a data URI, or the path of a file already used by the descriptions, like
+// its other files: clients can't have the service read any other file.
+func (s *service) renderInlineDescription(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := s.newGenerateRequest(r)
+	req.init()
+
+	err := r.ParseForm()
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "parsing form")))
+		return
+	}
+
+	var in inlineRequest
+	err = read(r, &in)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "parsing payload")))
+		return
+	}
+
+	desc, err := prepareDescription(in.Description)
+	if err == nil {
+		err = s.checkInlinePaths(desc)
+	}
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "description")))
+		return
+	}
+
+	if isRemote(desc.Base) {
+		req.baseImage, err = s.fetchInlineBase(r.Context(), desc.Base)
+		if err != nil {
+			writeError(rw, status(err), err)
+			return
+		}
+	}
+
+	req.descriptions = map[string]description{inlineName: desc}
+	req.aliases = nil
+	req.payload = in.payload
+	req.payload.Base = inlineName
+	req.render()
+	s.writeImage(rw, req, "")
+}
+
+// isRemote returns whether the base of an inline description is a URL or a
+// data URI rather than a path.
+func isRemote(base string) bool {
+	return strings.HasPrefix(base, "http://") || strings.HasPrefix(base, "https://") || strings.HasPrefix(base, "data:")
+}
+
+// checkInlinePaths returns an error if the inline description uses files the
+// registered descriptions don't.
+func (s *service) checkInlinePaths(desc description) error {
+	known := make(map[string]bool)
+	for _, d := range s.getDescriptions() {
+		for _, path := range d.paths() {
+			known[path] = true
+		}
+	}
+
+	for _, path := range desc.paths() {
+		if path == desc.Base && isRemote(path) {
+			continue
+		}
+		if !known[path] {
+			return fmt.Errorf(`file %q isn't used by any description, inline descriptions can only use those`, path)
+		}
+	}
+	return nil
+}
+
+// paths returns the paths of the files used by the description: its base,
+// fonts and the images of its layers.
+func (d description) paths() []string {
+	var paths []string
+	if d.Base != "" {
+		paths = append(paths, d.Base)
+	}
+	if d.Font != "" {
+		paths = append(paths, d.Font)
+	}
+	paths = append(paths, d.Fallbacks...)
+	for _, l := range d.Layers {
+		if l.Type == layerImage {
+			paths = append(paths, l.Path)
+		}
+	}
+	return paths
+}
+
+// fetchInlineBase decodes the base of an inline description, either from a
+// data URI or from its URL.
+func (s *service) fetchInlineBase(ctx context.Context, base string) (image.Image, error) {
+	if strings.HasPrefix(base, "data:") {
+		i := strings.Index(base, ",")
+		if i == -1 || !strings.HasSuffix(base[:i], ";base64") {
+			return nil, badRequest(codeInvalidPayload, fmt.Errorf(`invalid data URI, must be base64 encoded`))
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(base[i+1:])
+		if err != nil {
+			return nil, badRequest(codeInvalidPayload, wrap(err, "decoding data URI"))
+		}
+		return decodeImage(bytes.NewReader(raw), "base", s.maxImagePixels)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, inlineTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base, nil)
+	if err != nil {
+		return nil, badRequest(codeInvalidPayload, wrap(err, "invalid base URL"))
+	}
+
+	res, err := inlineClient.Do(req)
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, upstream(http.StatusBadGateway, fmt.Errorf(`fetching base: upstream responded with status %s`, res.Status))
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body, maxInlineBase+1))
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	if len(raw) > maxInlineBase {
+		return nil, badRequest(codeImageTooLarge, fmt.Errorf(`base is larger than %d bytes`, maxInlineBase))
+	}
+
+	return decodeImage(bytes.NewReader(raw), base, s.maxImagePixels)
+}
+
+// fetchError marks an error fetching a base as caused by its server, which
+// timed out if the deadline of the fetch passed, unless the base was on a
+// private address.
+func fetchError(err error) error {
+	if errors.Is(err, errPrivateAddress) {
+		return badRequest(codeInvalidPayload, wrap(err, "fetching base"))
+	}
+
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return upstream(http.StatusGatewayTimeout, wrap(err, "fetching base"))
+	}
+	return upstream(http.StatusBadGateway, wrap(err, "fetching base"))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchInlineBase(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/base.png":
+			_, _ = rw.Write(buf.Bytes())
+		case "/slow.png":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		case "/down.png":
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	// The test servers listen on loopback, which the client refuses by
+	// default.
+	defer func(c *http.Client) { inlineClient = c }(inlineClient)
+	inlineClient = newInlineClient(true)
+
+	s := &service{maxImagePixels: maxDimension * maxDimension}
+	for _, c := range []struct {
+		name    string
+		url     string
+		status  int
+		message string
+	}{
+		{name: "ok", url: upstream.URL + "/base.png"},
+		{name: "unavailable", url: upstream.URL + "/down.png", status: http.StatusBadGateway, message: "503"},
+		{name: "not found", url: upstream.URL + "/missing.png", status: http.StatusBadGateway, message: "404"},
+		{name: "timeout", url: upstream.URL + "/slow.png", status: http.StatusGatewayTimeout},
+		{name: "unreachable", url: closed.URL + "/base.png", status: http.StatusBadGateway},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			img, err := s.fetchInlineBase(ctx, c.url)
+			if c.status == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if img.Bounds().Dx() != 4 {
+					t.Errorf("unexpected width %d", img.Bounds().Dx())
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := status(err); got != c.status {
+				t.Errorf("expected status %d, got %d (%s)", c.status, got, err)
+			}
+			if got := errorCode(status(err), err); got != codeUpstreamError {
+				t.Errorf("expected code %q, got %q", codeUpstreamError, got)
+			}
+			if !strings.Contains(err.Error(), c.message) {
+				t.Errorf("expected %q in the error, got %q", c.message, err)
+			}
+		})
+	}
+}
+
+func TestFetchInlineBasePrivate(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	s := &service{maxImagePixels: maxDimension * maxDimension}
+	_, err := s.fetchInlineBase(context.Background(), upstream.URL+"/base.png")
+	if err == nil || !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("expected the loopback address to be refused, got %v", err)
+	}
+	if got := status(err); got != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, got)
+	}
+
+	for ip, private := range map[string]bool{
+		"127.0.0.1":     true,
+		"10.1.2.3":      true,
+		"172.20.0.1":    true,
+		"192.168.1.1":   true,
+		"169.254.0.1":   true,
+		"::1":           true,
+		"fd00::1":       true,
+		"93.184.216.34": false,
+		"2606:4700::1":  false,
+	} {
+		if got := isPrivate(net.ParseIP(ip)); got != private {
+			t.Errorf("%s: expected private to be %v", ip, private)
+		}
+	}
+}
+
+func TestRenderInlineBounds(t *testing.T) {
+	s := newTestService(t)
+
+	for _, c := range []struct {
+		name  string
+		desc  string
+		error string
+	}{
+		{name: "valid", desc: `{"width": 100, "height": 100, "question": {"size": 10, "x": 10, "y": 50}, "answers": []}`},
+		{name: "font size", desc: `{"width": 100, "height": 100, "question": {"size": 1000000, "x": 10, "y": 50}, "answers": []}`, error: "invalid size"},
+		{name: "stroke width", desc: `{"width": 100, "height": 100, "question": {"size": 10, "x": 10, "y": 50, "strokeWidth": 100000}, "answers": []}`, error: "invalid stroke width"},
+		{name: "shadow blur", desc: `{"width": 100, "height": 100, "question": {"size": 10, "x": 10, "y": 50, "shadowBlur": 100000}, "answers": []}`, error: "invalid shadow blur"},
+		{name: "layer image", desc: `{"width": 100, "height": 100, "question": {"size": 10}, "answers": [], "layers": [{"type": "image", "path": "layer.png", "width": 1000000, "height": 1000000}]}`, error: "out of bounds"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			body := `{"description": ` + c.desc + `, "question": "Question ?"}`
+			r := httptest.NewRequest(http.MethodPost, "/render-inline", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			rw := httptest.NewRecorder()
+			s.renderInlineDescription(rw, r, nil)
+
+			if c.error == "" {
+				if rw.Code != http.StatusOK {
+					t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rw.Code, rw.Body)
+				}
+				return
+			}
+			if rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), c.error) {
+				t.Fatalf("expected status %d with %q, got %d: %s", http.StatusBadRequest, c.error, rw.Code, rw.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// errQueueFull is returned when a job is submitted to a full queue.
+var errQueueFull = errors.New("too many pending jobs, retry later")
+
+// Statuses of jobs.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// job is a generation request rendered in the background.
+type job struct {
+	id  string
+	req *generateRequest
+
+	// Guarded by the mutex of the queue.
+	status  string
+	data    []byte
+	err     error
+	expires time.Time
+}
+
+// jobQueue holds the jobs, from their submission until their result expires.
+// Pending jobs wait in a bounded queue for a worker to render them.
+type jobQueue struct {
+	ttl   time.Duration
+	queue chan *job
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// newJobQueue returns a queue holding at most size pending jobs, whose
+// results are kept for the TTL.
+func newJobQueue(size int, ttl time.Duration) *jobQueue {
+	return &jobQueue{
+		ttl:   ttl,
+		queue: make(chan *job, size),
+		jobs:  make(map[string]*job),
+	}
+}
+
+// submit queues the job, and evicts the expired ones on the way.
+func (q *jobQueue) submit(j *job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for id, j := range q.jobs {
+		if !j.expires.IsZero() && now.After(j.expires) {
+			delete(q.jobs, id)
+		}
+	}
+
+	select {
+	case q.queue <- j:
+		j.status = jobPending
+		q.jobs[j.id] = j
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// work renders the queued jobs until the context is done.
+func (q *jobQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-q.queue:
+			q.run(j)
+		}
+	}
+}
+
+// run renders the job as a PNG image.
+func (q *jobQueue) run(j *job) {
+	q.mu.Lock()
+	j.status = jobRunning
+	q.mu.Unlock()
+
+	var buf bytes.Buffer
+	j.req.render()
+	if j.req.err == nil {
+		j.req.err = j.req.encode(&buf, "image/png")
+		j.req.logTimings()
+	}
+	if j.req.err != nil {
+		j.req.logger.Error("rendering job", "err", j.req.err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.status, j.data, j.err = jobDone, buf.Bytes(), j.req.err
+	if j.err != nil {
+		j.status, j.data = jobFailed, nil
+	}
+	j.expires = time.Now().Add(q.ttl)
+}
+
+// get returns a copy of the job, with its image or error once rendered.
+func (q *jobQueue) get(id string) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok || (!j.expires.IsZero() && time.Now().After(j.expires)) {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// jobResponse describes a job not yet rendered, or failed.
+type jobResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+// newJobID returns a random id for a job. Request ids are predictable, so
+// jobs get their own, only known to the client submitting them.
+func newJobID() (string, error) {
+	var raw [16]byte
+	_, err := rand.Read(raw[:])
+	if err != nil {
+		return "", wrap(err, "generating job id")
+	}
+	return hex.EncodeToString(raw[:]), nil
+}
+
+// submitJob reads the payload, and queues its rendering. The response gives
+// the id of the job, whose image is then served by getJob.
+func (s *service) submitJob(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := s.newGenerateRequest(r)
+	req.init()
+	req.readPayload()
+	if req.err != nil {
+		writeError(rw, status(req.err), req.err)
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.jobs.submit(&job{id: id, req: req})
+	if err != nil {
+		writeError(rw, http.StatusTooManyRequests, err)
+		return
+	}
+
+	rw.Header().Set("Location", "/jobs/"+id)
+	write(rw, http.StatusAccepted, jobResponse{ID: id, Status: jobPending})
+}
+
+// getJob serves the image of a job once rendered, and its status until then.
+func (s *service) getJob(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	j, ok := s.jobs.get(id)
+	if !ok {
+		writeError(rw, http.StatusNotFound, fmt.Errorf(`job %q not found`, id))
+		return
+	}
+
+	switch j.status {
+	case jobDone:
+		rw.Header().Set("Content-Type", "image/png")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(j.data)))
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(j.data)
+	case jobFailed:
+		write(rw, http.StatusOK, jobResponse{ID: id, Status: j.status, Error: &Error{
+			Err:  j.err.Error(),
+			Code: errorCode(status(j.err), j.err),
+		}})
+	default:
+		write(rw, http.StatusOK, jobResponse{ID: id, Status: j.status})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubmitJobID(t *testing.T) {
+	s := newTestService(t)
+	s.jobs = newJobQueue(2, s.jobs.ttl)
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"question": "Question ?"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, "c0ffee"))
+		rw := httptest.NewRecorder()
+		s.submitJob(rw, r, nil)
+
+		if rw.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rw.Code, rw.Body)
+		}
+
+		var res jobResponse
+		err := json.Unmarshal(rw.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.ID) != 32 || res.ID == "c0ffee" {
+			t.Errorf("expected a random id of 32 characters, got %q", res.ID)
+		}
+		if ids[res.ID] {
+			t.Errorf("id %q given twice", res.ID)
+		}
+		ids[res.ID] = true
+
+		if _, ok := s.jobs.get(res.ID); !ok {
+			t.Errorf("job %q not found", res.ID)
+		}
+	}
+}
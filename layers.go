@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"time"
+)
+
+// Types of layers.
+const (
+	layerQuestion = "question"
+	layerAnswer   = "answer"
+	layerText     = "text"
+	layerFill     = "fill"
+	layerImage    = "image"
+)
+
+// layer is an element of the image, drawn over the base in the order of the
+// layers of the description. Question and answer layers draw the blocks of
+// the description, text layers their own block with its text, fill layers a
+// rectangle of color, and image layers an image file.
+//
+// The block gives the position of fill and image layers, and their width
+// along with the height. A fill without dimensions extends to the edges of
+// the image, and an image without dimensions keeps its own, or its ratio if
+// only one is given.
+type layer struct {
+	Type string `json:"type"`
+	block
+
+	// Answer is the index of the answer block drawn by answer layers.
+	Answer int `json:"answer,omitempty"`
+
+	// Path is the path of the image drawn by image layers.
+	Path string `json:"path,omitempty"`
+
+	Height float64 `json:"height,omitempty"`
+}
+
+// layers returns the layers of the description. Descriptions without layers
+// get them from their static blocks, question and answers, drawn in that
+// order, the static blocks that are over the others last.
+func (d description) layers() []layer {
+	if len(d.Layers) != 0 {
+		return d.Layers
+	}
+
+	var layers []layer
+	for _, b := range d.Static {
+		if !b.Over {
+			layers = append(layers, layer{Type: layerText, block: b})
+		}
+	}
+	layers = append(layers, layer{Type: layerQuestion})
+	for i := range d.Answers {
+		layers = append(layers, layer{Type: layerAnswer, Answer: i})
+	}
+	for _, b := range d.Static {
+		if b.Over {
+			layers = append(layers, layer{Type: layerText, block: b})
+		}
+	}
+	return layers
+}
+
+// check returns an error if the layer is invalid for the description.
+func (l layer) check(desc description) error {
+	switch l.Type {
+	case layerQuestion, layerText:
+	case layerAnswer:
+		if l.Answer < 0 || l.Answer >= len(desc.Answers) {
+			return fmt.Errorf("answer %d out of bounds, must be between 0 and %d", l.Answer, len(desc.Answers)-1)
+		}
+	case layerFill:
+		_, err := parseColor(l.Color)
+		if err != nil {
+			return err
+		}
+	case layerImage:
+		if l.Path == "" {
+			return fmt.Errorf("image layers must have a path")
+		}
+	default:
+		return fmt.Errorf(`unknown layer type %q, must be question, answer, text, fill or image`, l.Type)
+	}
+
+	if l.Width < 0 || l.Width > maxDimension || l.Height < 0 || l.Height > maxDimension {
+		return fmt.Errorf("dimensions %vx%v out of bounds, must be between 0 and %d", l.Width, l.Height, maxDimension)
+	}
+	return nil
+}
+
+// layerStages are the stages the drawing of each type of layer is measured
+// as.
+var layerStages = map[string]string{
+	layerText:     "write_static",
+	layerQuestion: "write_question",
+	layerAnswer:   "write_answers",
+	layerFill:     "draw_fills",
+	layerImage:    "draw_images",
+}
+
+// writeLayers draws the layers of the description, in order. As layers of
+// different types are interleaved, each layer is traced on its own, and the
+// durations are logged summed by type, in the order the types first appear.
+func (r *generateRequest) writeLayers() {
+	if r.err != nil {
+		return
+	}
+
+	var stages []string
+	durations := make(map[string]time.Duration)
+	defer func() {
+		for _, stage := range stages {
+			r.timings = append(r.timings, stage, durations[stage])
+		}
+	}()
+
+	for _, l := range r.desc.layers() {
+		start := time.Now()
+		r.drawLayer(l)
+
+		stage := layerStages[l.Type]
+		traceStage(r.r.Context(), r.uid, stage, start)
+		if _, ok := durations[stage]; !ok {
+			stages = append(stages, stage)
+		}
+		durations[stage] += time.Since(start)
+
+		if r.err != nil {
+			return
+		}
+	}
+}
+
+// drawLayer draws a layer of the description.
+func (r *generateRequest) drawLayer(l layer) {
+	switch l.Type {
+	case layerQuestion:
+		r.drawText(r.desc.Question, r.question)
+	case layerAnswer:
+		r.drawAnswer(l.Answer)
+	case layerText:
+		r.drawText(l.block, l.Text)
+	case layerFill:
+		r.drawFill(l)
+	case layerImage:
+		r.drawImage(l)
+	}
+}
+
+// drawAnswer draws the answer in its block, highlighted if it is the correct
+// one.
+func (r *generateRequest) drawAnswer(i int) {
+	if i >= len(r.answers) || i >= len(r.desc.Answers) {
+		return
+	}
+
+	b := r.answerBlock(i)
+	if i == r.correct {
+		b = b.with(r.highlight)
+	}
+	r.drawText(r.answers[i].apply(b), r.prefixed(i))
+}
+
+// drawFill fills the rectangle of the layer with its color.
+func (r *generateRequest) drawFill(l layer) {
+	min := r.layerPoint(l)
+	max := r.image.Bounds().Max
+	if l.Width != 0 {
+		max.X = min.X + int(l.Width*r.dpi)
+	}
+	if l.Height != 0 {
+		max.Y = min.Y + int(l.Height*r.dpi)
+	}
+
+	c := image.NewUniform(parseColorOr(l.Color, color.Transparent))
+	draw.Draw(r.image, image.Rectangle{Min: min, Max: max}, c, image.Point{}, draw.Over)
+}
+
+// drawImage draws the image of the layer at its position, resized to its
+// dimensions if it has any.
+func (r *generateRequest) drawImage(l layer) {
+	src, err := r.baseCache.get(l.Path)
+	if err != nil {
+		r.err = wrap(err, "reading layer image")
+		return
+	}
+
+	b := src.Bounds()
+	width, height := l.Width, l.Height
+	switch {
+	case width == 0 && height == 0:
+		width, height = float64(b.Dx()), float64(b.Dy())
+	case width == 0:
+		width = height * float64(b.Dx()) / float64(b.Dy())
+	case height == 0:
+		height = width * float64(b.Dy()) / float64(b.Dx())
+	}
+
+	w, h := int(width*r.dpi), int(height*r.dpi)
+	if w != b.Dx() || h != b.Dy() {
+		src = resize(src, w, h)
+		b = src.Bounds()
+	}
+
+	min := r.layerPoint(l)
+	draw.Draw(r.image, b.Sub(b.Min).Add(min), src, b.Min, draw.Over)
+}
+
+// layerPoint returns the position of the layer in the image.
+func (r *generateRequest) layerPoint(l layer) image.Point {
+	return image.Pt(
+		int(float64(l.X.resolve(r.templateWidth))*r.dpi),
+		int(float64(l.Y.resolve(r.templateHeight))*r.dpi),
+	)
+}
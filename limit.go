@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// renderWait is how long a request waits for a render slot before being
+// rejected.
+const renderWait = 1 * time.Second
+
+// rendersInFlight is the number of requests currently rendering, exposed
+// under /debug/vars.
+var rendersInFlight = expvar.NewInt("renders_in_flight")
+
+// limit restricts the handler to -max-concurrent requests at once. Requests
+// still waiting for a slot after renderWait are rejected, so clients back off
+// instead of piling up.
+func (s *service) limit(h httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if s.renders != nil {
+			timer := time.NewTimer(renderWait)
+			select {
+			case s.renders <- struct{}{}:
+				timer.Stop()
+				defer func() { <-s.renders }()
+			case <-timer.C:
+				rw.Header().Set("Retry-After", strconv.Itoa(int(renderWait/time.Second)))
+				writeError(rw, http.StatusServiceUnavailable, errors.New("too many renders in progress"))
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		rendersInFlight.Add(1)
+		defer rendersInFlight.Add(-1)
+		h(rw, r, p)
+	}
+}
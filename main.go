@@ -1,24 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"image"
+	_ "image/gif"
 	_ "image/jpeg"
 	"image/png"
-	_ "image/png"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/golang/freetype/truetype"
 	"github.com/inconshreveable/log15"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
+	"github.com/rs/xid"
 	"github.com/urfave/negroni"
+	_ "golang.org/x/image/webp"
 )
 
 // main is tasked to bootstrap the service and notify of termination signals.
@@ -32,6 +47,28 @@ func main() {
 		os.Exit(1)
 	}
 
+	if s.check || s.selftest {
+		errs := s.validate()
+		for _, err := range errs {
+			s.logger.Error("validating configuration", "err", err)
+		}
+		if len(errs) != 0 {
+			os.Exit(1)
+		}
+
+		if s.selftest {
+			errs = s.renderSamples()
+			for _, err := range errs {
+				s.logger.Error("rendering sample", "err", err)
+			}
+			if len(errs) != 0 {
+				os.Exit(1)
+			}
+		}
+		s.logger.Info("configuration is valid")
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		signals := make(chan os.Signal, 2)
@@ -45,24 +82,346 @@ func main() {
 
 type service struct {
 	// Configuration.
-	bind             string
-	descriptionsPath string
+	config                  string
+	check                   bool
+	selftest                bool
+	bind                    string
+	shutdownTimeout         time.Duration
+	pprof                   bool
+	logSampleRate           float64
+	logSlowThreshold        time.Duration
+	noCORS                  bool
+	debugHeaders            bool
+	tlsCert                 string
+	tlsKey                  string
+	tlsRedirect             string
+	descriptionsPath        string
+	descriptionsDir         string
+	fontsDir                string
+	emojiFontPath           string
+	defaultBase             string
+	caseSensitiveBases      bool
+	preload                 bool
+	placeholderPath         string
+	maxBatch                int
+	maxTextLen              int
+	maxImagePixels          int
+	maxConcurrent           int
+	renderInline            bool
+	fontCacheSize           int
+	sanitizeText            bool
+	stripMissingGlyphs      bool
+	missingGlyphReplacement string
+	shareTTL                time.Duration
+	storageDir              string
+	pngCompressionName      string
+	watermarkPath           string
+	watermarkPosition       string
+	watermarkMargin         int
+	watermarkOpacity        float64
+	otlpEndpoint            string
+	publicURL               string
+	slackSigningSecret      string
+	discordWebhook          string
+	adminToken              string
+	adminPersist            bool
+	jobWorkers              int
+	jobQueueSize            int
+	jobTTL                  time.Duration
 
 	// Dependencies
-	logger       log15.Logger
-	descriptions map[string]description
+	logger log15.Logger
+
+	// The descriptions can be reloaded while requests are served. The map
+	// is replaced rather than modified, so readers can keep using the one
+	// they got.
+	descriptionsMu sync.RWMutex
+	descriptions   map[string]description
+	aliases        map[string]string
+
+	baseCache   *baseCache
+	placeholder image.Image
+	fonts       *fontCache
+	fallbacks   []*truetype.Font
+	emoji       *emojiFont
+	store       store
+	jobs        *jobQueue
+	renders     chan struct{}
+	watermark   image.Image
+	stopTracing func()
+
+	pngCompression png.CompressionLevel
 }
 
 type description struct {
+	Name     string  `json:"name,omitempty"`
 	Base     string  `json:"base"`
+	Font     string  `json:"font,omitempty"`
 	Question block   `json:"question"`
 	Answers  []block `json:"answers"`
+
+	// Grid lays the answers out in cells instead of their blocks.
+	Grid *grid `json:"grid,omitempty"`
+
+	// Balance lays the answers out in columns, according to the number of
+	// answers of each request.
+	Balance *balance `json:"balance,omitempty"`
+
+	// MaxAnswers is the number of answers the description accepts. It
+	// defaults to the number of answer blocks.
+	MaxAnswers int `json:"maxAnswers,omitempty"`
+
+	// AnswerPrefixes are prepended to the answers, in order.
+	AnswerPrefixes []string `json:"answerPrefixes,omitempty"`
+
+	// Highlight is the style applied to the correct answer.
+	Highlight style `json:"highlight"`
+
+	// Static blocks are drawn with their own text on every image, below
+	// the question and answers unless they are Over them.
+	Static []block `json:"static,omitempty"`
+
+	// Layers are drawn in order over the base. Without them, the static
+	// blocks, question and answers are drawn.
+	Layers []layer `json:"layers,omitempty"`
+
+	// Aliases are other names the description can be requested by, such
+	// as the former name of a renamed description or a number.
+	Aliases []string `json:"aliases,omitempty"`
+
+	// Fallbacks are the paths of the fonts used, in order, for the glyphs
+	// missing from the font.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+
+	// SafeArea is kept free of text: blocks are moved inside it, and their
+	// texts wrapped at its edge.
+	SafeArea insets `json:"safeArea"`
+
+	// Format is the extension of the format images are rendered in when
+	// the client doesn't ask for one: png (the default), jpg or jpeg.
+	Format string `json:"format,omitempty"`
+
+	// Colors is the size of the palette PNG images are reduced to, for
+	// templates with few colors. They are in full color by default.
+	Colors int `json:"colors,omitempty"`
+
+	// Background is the color filling the image under the base.
+	Background string `json:"background,omitempty"`
+
+	// Width and Height declare the dimensions of the canvas independently
+	// of the base, which is then optional and drawn at BaseX, BaseY.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	BaseX  int `json:"baseX,omitempty"`
+	BaseY  int `json:"baseY,omitempty"`
+}
+
+// contentType returns the content type of the format of the description, PNG
+// by default.
+func (d description) contentType() string {
+	contentType, ok := extensions[d.Format]
+	if !ok {
+		return "image/png"
+	}
+	return contentType
+}
+
+// maxAnswers returns the number of answers the description accepts.
+func (d description) maxAnswers() int {
+	if d.MaxAnswers != 0 {
+		return d.MaxAnswers
+	}
+	return len(d.Answers)
+}
+
+// answerIndex returns the index of the answer block with the given name, or
+// -1 if there is none.
+func (d description) answerIndex(name string) int {
+	for i, b := range d.Answers {
+		if b.Name != "" && b.Name == name {
+			return i
+		}
+	}
+	return -1
 }
 
 type block struct {
-	Size float64 `json:"size"`
-	X    int     `json:"x"`
-	Y    int     `json:"y"`
+	Name     string     `json:"name,omitempty"`
+	Size     float64    `json:"size"`
+	X        coordinate `json:"x"`
+	Y        coordinate `json:"y"`
+	Centered bool       `json:"centered"`
+	MaxChars int        `json:"maxChars,omitempty"`
+
+	// Width is the width texts are wrapped at, 0 for no wrapping, and
+	// MaxLines the maximum number of lines, 0 for no limit.
+	Width    float64 `json:"width,omitempty"`
+	MaxLines int     `json:"maxLines,omitempty"`
+
+	// MinSize is the size texts can shrink to, from Size, to fit the width
+	// and maximum lines of the block instead of overflowing or being
+	// truncated. They don't shrink by default.
+	MinSize float64 `json:"minSize,omitempty"`
+
+	// LineHeight multiplies the natural height of the lines of the font,
+	// 1 by default.
+	LineHeight float64 `json:"lineHeight,omitempty"`
+
+	// Color of the text, and of the box behind it, as hexadecimal colors.
+	// The text is white and has no box by default.
+	Color      string `json:"color,omitempty"`
+	Background string `json:"background,omitempty"`
+
+	// Gradient fills the text instead of its color.
+	Gradient *gradient `json:"gradient,omitempty"`
+
+	// ShadowColor is the color of a shadow drawn under the text, moved by
+	// ShadowOffsetX and ShadowOffsetY pixels and blurred over ShadowBlur
+	// pixels. There is no shadow by default.
+	ShadowColor   string  `json:"shadowColor,omitempty"`
+	ShadowOffsetX float64 `json:"shadowOffsetX,omitempty"`
+	ShadowOffsetY float64 `json:"shadowOffsetY,omitempty"`
+	ShadowBlur    float64 `json:"shadowBlur,omitempty"`
+
+	// StrokeColor is the color of an outline drawn around the text,
+	// StrokeWidth pixels wide, black by default. Hollow texts only have
+	// their outline, without fill. There is no outline by default.
+	StrokeColor string  `json:"strokeColor,omitempty"`
+	StrokeWidth float64 `json:"strokeWidth,omitempty"`
+	Hollow      bool    `json:"hollow,omitempty"`
+
+	// Opacity of the text, from 0 (invisible) to 1 (the default), applied
+	// over the alpha of its color or gradient. Values out of these bounds
+	// are clamped.
+	Opacity *float64 `json:"opacity,omitempty"`
+
+	// Direction is the writing direction of the text: "ltr", "rtl", or
+	// "auto" (the default) to detect it from the text itself.
+	Direction string `json:"direction"`
+
+	// LetterSpacing is the extra space in pixels between characters. It
+	// disables kerning when set.
+	LetterSpacing float64 `json:"letterSpacing,omitempty"`
+
+	// Bold and Italic style the text synthetically, for fonts without those
+	// styles.
+	Bold   bool `json:"bold,omitempty"`
+	Italic bool `json:"italic,omitempty"`
+
+	// Text and Over are only used by static blocks, to set the text drawn
+	// and whether it is drawn after the question and answers.
+	Text string `json:"text,omitempty"`
+	Over bool   `json:"over,omitempty"`
+
+	// balanced blocks are laid out according to the number of answers.
+	balanced bool
+}
+
+// lineHeight returns the multiplier of the height of the lines of the block.
+func (b block) lineHeight() float64 {
+	if b.LineHeight == 0 {
+		return 1
+	}
+	return b.LineHeight
+}
+
+// opacity returns the opacity of the text of the block.
+func (b block) opacity() float64 {
+	if b.Opacity == nil {
+		return 1
+	}
+	return math.Max(0, math.Min(1, *b.Opacity))
+}
+
+// with returns a copy of the block with the style applied. Its color
+// replaces the gradient of the block too.
+func (b block) with(s style) block {
+	if s.Color != "" {
+		b.Color = s.Color
+		b.Gradient = nil
+	}
+	if s.Background != "" {
+		b.Background = s.Background
+	}
+	return b
+}
+
+// defaultHighlight is the color of the correct answer when the description
+// doesn't style it.
+const defaultHighlight = "#ff8c00"
+
+// insets are margins along the edges of the image, in pixels.
+type insets struct {
+	Top    float64 `json:"top,omitempty"`
+	Right  float64 `json:"right,omitempty"`
+	Bottom float64 `json:"bottom,omitempty"`
+	Left   float64 `json:"left,omitempty"`
+}
+
+// style overrides the colors of a block.
+type style struct {
+	Color      string `json:"color,omitempty"`
+	Background string `json:"background,omitempty"`
+}
+
+// resolved returns a copy of the block with absolute coordinates for an image
+// of the given dimensions.
+func (b block) resolved(width, height int) block {
+	b.X = coordinate{value: float64(b.X.resolve(width))}
+	b.Y = coordinate{value: float64(b.Y.resolve(height))}
+	return b
+}
+
+// coordinate is a position along one axis of the image. Positive numbers
+// are absolute positions, negative numbers are relative to the far edge of
+// the image (-50 being 50 pixels from the bottom for an ordinate), and
+// percentages ("80%") are relative to the dimension of the image.
+type coordinate struct {
+	value   float64
+	percent bool
+}
+
+// resolve the coordinate against the dimension of the image along its axis.
+func (c coordinate) resolve(dimension int) int {
+	v := c.value
+	if c.percent {
+		v = v * float64(dimension) / 100
+	}
+	if v < 0 {
+		v += float64(dimension)
+	}
+	return int(math.Round(v))
+}
+
+func (c *coordinate) UnmarshalJSON(raw []byte) error {
+	if string(raw) == "null" {
+		return nil
+	}
+
+	var s string
+	err := json.Unmarshal(raw, &s)
+	if err != nil {
+		c.percent = false
+		return json.Unmarshal(raw, &c.value)
+	}
+
+	if !strings.HasSuffix(s, "%") {
+		return fmt.Errorf(`invalid coordinate %q, must be a number or a percentage`, s)
+	}
+
+	c.percent = true
+	c.value, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return fmt.Errorf(`invalid coordinate %q, must be a number or a percentage`, s)
+	}
+	return nil
+}
+
+func (c coordinate) MarshalJSON() ([]byte, error) {
+	if c.percent {
+		return json.Marshal(strconv.FormatFloat(c.value, 'f', -1, 64) + "%")
+	}
+	return json.Marshal(c.value)
 }
 
 // configure read and validate the configuration of the service and populate
@@ -71,13 +430,159 @@ func (s *service) configure() {
 	fs := flag.NewFlagSet("votrederniermot", flag.ExitOnError)
 	fs.Usage = func() {
 		fmt.Fprintln(fs.Output(), "Usage of votrederniermot: votrederniermot [options]")
+		fmt.Fprintln(fs.Output(), "Options can also be set by environment variables (-default-base as VOTREDERNIERMOT_DEFAULT_BASE or VDM_DEFAULT_BASE) or the configuration file, flags taking precedence over environment variables, themselves taking precedence over the configuration file.")
 		fs.PrintDefaults()
 	}
 
 	// General options.
+	fs.StringVar(&s.config, "config", "", "path of a JSON configuration file whose keys are flag names, overridden by flags")
+	fs.BoolVar(&s.check, "check", false, "validate the configuration and exit")
+	fs.BoolVar(&s.selftest, "selftest", false, "validate the configuration, render a sample image of each description, and exit")
 	fs.StringVar(&s.bind, "bind", "localhost:8080", "address to listen to")
-	fs.StringVar(&s.descriptionsPath, "descriptions", "./descriptions.json", "")
+	fs.DurationVar(&s.shutdownTimeout, "shutdown-timeout", 1*time.Minute, "maximum duration in-flight requests are given to complete when stopping the server, before their connections are closed")
+	fs.BoolVar(&s.pprof, "pprof", false, "expose the profiling endpoints under /debug/pprof/ and the metrics under /debug/vars")
+	fs.Float64Var(&s.logSampleRate, "log-sample-rate", 1, "proportion of the requests logged, between 0 and 1, errors and slow requests being always logged")
+	fs.DurationVar(&s.logSlowThreshold, "log-slow-threshold", 1*time.Second, "duration from which requests are always logged")
+	fs.BoolVar(&s.noCORS, "no-cors", false, "don't handle CORS, when a proxy in front of the server does")
+	fs.BoolVar(&s.debugHeaders, "debug-headers", false, "add the base and dimensions of the images to the X-Base, X-Image-Width and X-Image-Height headers")
+	fs.StringVar(&s.descriptionsPath, "descriptions", "./descriptions.json", "path of the descriptions file (empty to disable)")
+	fs.StringVar(&s.descriptionsDir, "descriptions-dir", "", "directory of per-template description files")
+	fs.StringVar(&s.defaultBase, "default-base", "qvgdm", "base used when the request doesn't specify one")
+	fs.BoolVar(&s.caseSensitiveBases, "case-sensitive-bases", false, "distinguish base names by their case instead of lowercasing them")
+	fs.BoolVar(&s.preload, "preload", false, "decode every base image at startup instead of on first use")
+	fs.StringVar(&s.placeholderPath, "placeholder-image", "", "path of an image used in place of base images failing to load")
+
+	// Generation options.
+	fs.BoolVar(&s.sanitizeText, "sanitize-text", true, "normalize the texts and remove their control characters (-sanitize-text=false to draw them as is)")
+	fs.BoolVar(&s.stripMissingGlyphs, "strip-missing-glyphs", false, "remove the characters no font has a glyph for")
+	fs.StringVar(&s.missingGlyphReplacement, "missing-glyph-replacement", "", "character replacing the removed characters (with -strip-missing-glyphs)")
+	fs.StringVar(&s.fontsDir, "fonts-dir", "", "directory of fallback fonts for glyphs missing from the descriptions fonts (emoji, other scripts)")
+	fs.IntVar(&s.fontCacheSize, "font-cache-size", 32, "maximum number of fonts kept parsed in memory")
+	fs.StringVar(&s.emojiFontPath, "emoji-font", "", "path of a color emoji font (sbix or CBDT) to draw emoji with")
+	fs.StringVar(&s.pngCompressionName, "png-compression", "default", "compression level of PNG images: default, no, speed or best")
+	fs.IntVar(&s.maxTextLen, "max-text-len", 0, "maximum number of characters of each text (0 for no limit)")
+	fs.IntVar(&s.maxBatch, "max-batch", 16, "maximum number of images generated by a batch request")
+	fs.BoolVar(&s.renderInline, "render-inline", false, "enable /render-inline, rendering descriptions sent by clients with bases fetched from any URL")
+	fs.IntVar(&s.maxImagePixels, "max-image-pixels", maxDimension*maxDimension, "maximum number of pixels of the images sent or linked by clients (0 for no limit)")
+	fs.IntVar(&s.maxConcurrent, "max-concurrent", 0, "maximum number of requests rendering at once, more being rejected with a 503 (0 for no limit)")
+
+	// Watermark options.
+	fs.StringVar(&s.watermarkPath, "watermark-image", "", "path of an image drawn on every generated image")
+	fs.StringVar(&s.watermarkPosition, "watermark-position", "bottom-right", "corner of the watermark: top-left, top-right, bottom-left or bottom-right")
+	fs.IntVar(&s.watermarkMargin, "watermark-margin", 10, "distance in pixels between the watermark and the edges of the image")
+	fs.Float64Var(&s.watermarkOpacity, "watermark-opacity", 1, "opacity of the watermark, between 0 and 1")
+
+	// TLS options.
+	fs.StringVar(&s.tlsCert, "tls-cert", "", "path of the TLS certificate, to serve HTTPS")
+	fs.StringVar(&s.tlsKey, "tls-key", "", "path of the TLS private key, to serve HTTPS")
+	fs.StringVar(&s.tlsRedirect, "tls-redirect", "", "address to listen to for redirecting HTTP requests to HTTPS")
+
+	// Sharing options.
+	fs.DurationVar(&s.shareTTL, "share-ttl", 24*time.Hour, "duration shared images are kept in memory (0 to keep them forever)")
+	fs.StringVar(&s.storageDir, "storage-dir", "", "directory to persist shared images into instead of memory")
+
+	// Job options.
+	fs.IntVar(&s.jobWorkers, "job-workers", 2, "number of jobs rendered concurrently")
+	fs.IntVar(&s.jobQueueSize, "job-queue", 64, "maximum number of pending jobs, more being rejected")
+	fs.DurationVar(&s.jobTTL, "job-ttl", 10*time.Minute, "duration the results of jobs are kept once rendered")
+
+	// Integration options.
+	fs.StringVar(&s.publicURL, "public-url", "", "URL the service is reachable at, to link shared images from integrations")
+	fs.StringVar(&s.slackSigningSecret, "slack-signing-secret", "", "signing secret of the Slack app, to enable slash commands on /slack")
+	fs.StringVar(&s.discordWebhook, "discord-webhook", "", "Discord webhook /discord posts to when the request doesn't give one")
+
+	// Admin options.
+	fs.StringVar(&s.adminToken, "admin-token", "", "bearer token of the /admin endpoints, which are disabled without it")
+	fs.BoolVar(&s.adminPersist, "admin-persist", false, "write the descriptions replaced through /admin/descriptions back to the descriptions file or directory")
+
+	// Tracing options.
+	fs.StringVar(&s.otlpEndpoint, "otlp-endpoint", "", "address of the OpenTelemetry collector to export traces to (requires the otel build tag)")
 	fs.Parse(os.Args[1:])
+
+	err := loadEnv(fs)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		os.Exit(2)
+	}
+
+	if s.config != "" {
+		err := loadConfig(fs, s.config)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			os.Exit(2)
+		}
+	}
+
+	if (s.tlsCert == "") != (s.tlsKey == "") {
+		fmt.Fprintln(fs.Output(), "both -tls-cert and -tls-key must be provided to serve HTTPS")
+		os.Exit(2)
+	}
+
+	s.pngCompression, err = parsePNGCompression(s.pngCompressionName)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		os.Exit(2)
+	}
+
+	switch s.watermarkPosition {
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		fmt.Fprintln(fs.Output(), "-watermark-position must be one of top-left, top-right, bottom-left or bottom-right")
+		os.Exit(2)
+	}
+
+	if s.watermarkOpacity < 0 || s.watermarkOpacity > 1 {
+		fmt.Fprintln(fs.Output(), "-watermark-opacity must be between 0 and 1")
+		os.Exit(2)
+	}
+
+	if s.logSampleRate < 0 || s.logSampleRate > 1 {
+		fmt.Fprintln(fs.Output(), "-log-sample-rate must be between 0 and 1")
+		os.Exit(2)
+	}
+
+	if s.jobWorkers < 1 || s.jobQueueSize < 1 {
+		fmt.Fprintln(fs.Output(), "-job-workers and -job-queue must be at least 1")
+		os.Exit(2)
+	}
+
+	if s.fontCacheSize < 1 {
+		fmt.Fprintln(fs.Output(), "-font-cache-size must be at least 1")
+		os.Exit(2)
+	}
+
+	if s.maxImagePixels < 0 {
+		fmt.Fprintln(fs.Output(), "-max-image-pixels must be positive")
+		os.Exit(2)
+	}
+
+	if s.maxConcurrent < 0 {
+		fmt.Fprintln(fs.Output(), "-max-concurrent must be positive")
+		os.Exit(2)
+	}
+
+	if utf8.RuneCountInString(s.missingGlyphReplacement) > 1 {
+		fmt.Fprintln(fs.Output(), "-missing-glyph-replacement must be a single character")
+		os.Exit(2)
+	}
+
+	if s.slackSigningSecret != "" && s.publicURL == "" {
+		fmt.Fprintln(fs.Output(), "-slack-signing-secret requires -public-url")
+		os.Exit(2)
+	}
+
+	if s.discordWebhook != "" {
+		err := checkDiscordWebhook(s.discordWebhook)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			os.Exit(2)
+		}
+	}
+
+	if s.tlsRedirect != "" && s.tlsCert == "" {
+		fmt.Fprintln(fs.Output(), "-tls-redirect requires -tls-cert and -tls-key")
+		os.Exit(2)
+	}
 }
 
 // init does the actual bootstraping of the service, once the configuration is
@@ -86,14 +591,98 @@ func (s *service) init() (err error) {
 	s.logger.SetHandler(log15.StreamHandler(os.Stdout, log15.LogfmtFormat()))
 
 	// Parse the descriptions.
-	raw, err := ioutil.ReadFile(s.descriptionsPath)
+	s.descriptions, err = s.loadDescriptions()
+	if err != nil {
+		return err
+	}
+
+	s.aliases, err = aliasesOf(s.descriptions)
 	if err != nil {
-		return wrap(err, "reading descriptions file")
+		return err
+	}
+
+	if _, ok := s.descriptions[resolveBase(s.aliases, s.defaultBase, s.caseSensitiveBases)]; !ok {
+		return fmt.Errorf(`default base %q not found in the descriptions`, s.defaultBase)
+	}
+
+	if s.placeholderPath != "" {
+		s.placeholder, err = readImage(s.placeholderPath)
+		if err != nil {
+			return wrap(err, "loading placeholder image")
+		}
+	}
+
+	// Unreadable bases are only tolerated when there is a placeholder to
+	// replace them.
+	err = checkBases(s.descriptions)
+	if err != nil && s.placeholder == nil {
+		return err
+	}
+	if err != nil {
+		s.logger.Warn("checking bases", "err", err)
+	}
+
+	s.baseCache = newBaseCache()
+	if s.preload {
+		start := time.Now()
+		n, err := s.baseCache.preload(s.descriptions)
+		if err != nil {
+			return wrap(err, "preloading bases")
+		}
+		s.logger.Info("preloaded bases", "count", n, "duration", time.Since(start))
+	}
+
+	// Parse the fonts used by the descriptions.
+	s.fonts, err = newFontCache(s.fontCacheSize)
+	if err != nil {
+		return err
+	}
+	err = checkFonts(s.fonts, s.descriptions)
+	if err != nil {
+		return err
+	}
+
+	if s.fontsDir != "" {
+		s.fallbacks, err = loadFallbacks(s.fontsDir)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = json.Unmarshal(raw, &s.descriptions)
+	if s.emojiFontPath != "" {
+		s.emoji, err = parseEmojiFont(s.emojiFontPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.watermarkPath != "" {
+		s.watermark, err = readImage(s.watermarkPath)
+		if err != nil {
+			return wrap(err, "loading watermark")
+		}
+	}
+
+	// Prepare the storage for shared images.
+	if s.storageDir != "" {
+		err = os.MkdirAll(s.storageDir, 0755)
+		if err != nil {
+			return wrap(err, "creating storage directory")
+		}
+		s.store = diskStore{dir: s.storageDir}
+	} else {
+		s.store = newMemoryStore(s.shareTTL)
+	}
+
+	s.jobs = newJobQueue(s.jobQueueSize, s.jobTTL)
+
+	if s.maxConcurrent != 0 {
+		s.renders = make(chan struct{}, s.maxConcurrent)
+	}
+
+	err = s.initTracing()
 	if err != nil {
-		return wrap(err, "parsing descriptions file")
+		return err
 	}
 
 	return nil
@@ -105,16 +694,65 @@ func (s *service) run(ctx context.Context) {
 	router := httprouter.New()
 	router.NotFound = http.HandlerFunc(s.notFound)
 	router.MethodNotAllowed = http.HandlerFunc(s.methodNotAllowed)
-	router.GET("/", s.root)
+	router.GET("/", s.limit(s.root))
+	router.POST("/", s.limit(s.root))
+	router.GET("/render.:ext", s.limit(s.renderExtension))
+	router.POST("/render.:ext", s.limit(s.renderExtension))
+	router.POST("/share", s.limit(s.share))
+	router.POST("/batch", s.limit(s.batch))
+	if s.renderInline {
+		router.POST("/render-inline", s.limit(s.renderInlineDescription))
+	}
+	router.POST("/validate", s.validatePayload)
+	router.POST("/discord", s.limit(s.discord))
+	router.GET("/i/:id", s.shared)
+	router.POST("/jobs", s.submitJob)
+	router.GET("/jobs/:id", s.getJob)
+	router.GET("/bases", s.bases)
+	router.GET("/healthz", s.livez)
+	router.GET("/livez", s.livez)
+	router.GET("/readyz", s.readyz)
+	router.GET("/version", s.version)
+	if s.adminToken != "" {
+		router.POST("/admin/reload/:base", s.admin(s.reloadDescription))
+		router.PUT("/admin/descriptions/:base", s.admin(s.putDescription))
+	}
+	router.GET("/descriptions/:base", s.describe)
+	router.GET("/descriptions/:base/image", s.baseImage)
+	if s.slackSigningSecret != "" {
+		router.POST("/slack", s.limit(s.slack))
+	}
+	if s.pprof {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		router.Handler(http.MethodGet, "/debug/pprof/*item", mux)
+		router.Handler(http.MethodPost, "/debug/pprof/*item", mux)
+		router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	}
+
+	s.logger.Debug("starting job workers")
+	for i := 0; i < s.jobWorkers; i++ {
+		go s.jobs.work(ctx)
+	}
 
 	s.logger.Debug("registering middlewares")
 	stack := negroni.New()
-	stack.Use(negroni.NewRecovery())
+	stack.Use(negroni.HandlerFunc(s.trace))
+	stack.Use(negroni.HandlerFunc(s.recover))
 	stack.Use(negroni.HandlerFunc(s.logRequest))
-	stack.Use(cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
-	}))
+	if !s.noCORS {
+		stack.Use(cors.New(cors.Options{
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization"},
+			ExposedHeaders: []string{"X-Correct-Index", "X-Answer-Order", "X-Base", "X-Image-Width", "X-Image-Height"},
+		}))
+	}
+	stack.Use(negroni.HandlerFunc(s.compress))
 	stack.UseHandler(router)
 
 	s.logger.Debug("starting server")
@@ -122,16 +760,128 @@ func (s *service) run(ctx context.Context) {
 		Addr:    s.bind,
 		Handler: stack,
 	}
+
+	var redirect *http.Server
+	if s.tlsRedirect != "" {
+		s.logger.Debug("starting redirect server")
+		redirect = &http.Server{
+			Addr:    s.tlsRedirect,
+			Handler: http.HandlerFunc(s.redirectTLS),
+		}
+		go func() {
+			err := redirect.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Error("closing redirect server", "err", err)
+			}
+		}()
+	}
+
+	// The listener is closed as soon as the shutdown starts, but in-flight
+	// requests are only done once it returns.
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		<-ctx.Done()
-		ctx, _ := context.WithTimeout(ctx, 1*time.Minute)
-		server.Shutdown(ctx)
+		s.shutdown(redirect, server)
 	}()
-	err := server.ListenAndServe()
+
+	var err error
+	if s.tlsCert != "" {
+		err = server.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		s.logger.Error("closing server", "err", err)
 	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+	}
 	s.logger.Info("stopping server")
+
+	if s.stopTracing != nil {
+		s.stopTracing()
+	}
+}
+
+// shutdown stops the servers gracefully: they stop accepting connections, and
+// the requests in flight are given the shutdown timeout to complete, after
+// which their connections are closed. Nil servers are skipped.
+func (s *service) shutdown(servers ...*http.Server) {
+	// The context of the service is already done, so the grace period can't
+	// be derived from it.
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			s.logger.Error("shutting down server, in-flight requests were dropped", "addr", server.Addr, "err", err)
+			_ = server.Close()
+		}
+	}
+}
+
+// redirectTLS redirects plain HTTP requests to the HTTPS server.
+func (s *service) redirectTLS(rw http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	_, port, _ := net.SplitHostPort(s.bind)
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// contextKey is the type of the keys of the values stored in requests
+// contexts.
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// requestID returns the id attributed to the request by the recover
+// middleware.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Attribute an id to the request, and convert panics to an error response
+// carrying it, so they can be correlated with the logs.
+func (s *service) recover(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := xid.New().String()
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+	traceRequestID(r.Context(), id)
+
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+
+		s.logger.Error("panic", "uid", id, "err", err, "stack", string(debug.Stack()))
+
+		// If the response was already started, there is nothing left to do
+		// but to let the client get a truncated response.
+		if rw.(negroni.ResponseWriter).Written() {
+			return
+		}
+		write(rw, http.StatusInternalServerError, Error{
+			Err:  "internal error",
+			Code: codeInternalError,
+			ID:   id,
+		})
+	}()
+
+	next(rw, r)
 }
 
 // Log a request with a few metadata to ensure requests are monitorable.
@@ -140,10 +890,23 @@ func (s *service) logRequest(rw http.ResponseWriter, r *http.Request, next http.
 
 	next(rw, r)
 
+	// Errors and slow requests are always logged, the others only in the
+	// proportion of the sample rate.
 	res := rw.(negroni.ResponseWriter)
-	s.logger.Info("request",
+	duration := time.Since(start)
+	if res.Status() < http.StatusBadRequest && duration < s.logSlowThreshold && rand.Float64() >= s.logSampleRate {
+		return
+	}
+
+	log := s.logger.Info
+	if probes[r.URL.Path] {
+		log = s.logger.Debug
+	}
+
+	log("request",
+		"uid", requestID(r.Context()),
 		"started_at", start,
-		"duration", time.Since(start),
+		"duration", duration,
 		"method", r.Method,
 		"path", r.URL.Path,
 		"status", res.Status(),
@@ -158,22 +921,219 @@ func (s *service) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf(`method %q not allowed for endpoint %q`, r.Method, r.URL.Path))
 }
 
+// rootOffers are the content types of the root endpoint, which can also
+// describe the image in JSON.
+var rootOffers = append(append([]string{}, offers...), "application/json")
+
+// root renders the image in the format of the Accept header. Clients not
+// naming a format get the one of the description.
 func (s *service) root(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	req := generateRequest{
-		r:            r,
-		logger:       s.logger,
-		descriptions: s.descriptions,
+	accept := r.Header.Get("Accept")
+	contentType := negotiate(accept, rootOffers)
+
+	rw.Header().Add("Vary", "Accept")
+	if contentType == "application/json" {
+		s.renderMetadata(rw, r)
+		return
+	}
+	if !explicit(accept, contentType) {
+		contentType = ""
+	}
+	s.render(rw, r, contentType)
+}
+
+// metadataResponse holds the generated image as a PNG data URI, along with
+// what it was generated from.
+type metadataResponse struct {
+	Image  string `json:"image"`
+	Base   string `json:"base"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	UID    string `json:"uid"`
+
+	// Order is the order the answers were drawn in when shuffled: the ith
+	// slot shows the answer given at Order[i].
+	Order []int `json:"order,omitempty"`
+}
+
+// renderMetadata generates the image and writes it with its metadata, so
+// clients needing both don't have to make two requests.
+func (s *service) renderMetadata(rw http.ResponseWriter, r *http.Request) {
+	req := s.generate(r)
+	if req.err != nil {
+		writeError(rw, status(req.err), req.err)
+		return
+	}
+
+	uri, err := dataURI(req.image, req.pngCompression)
+	req.logTimings()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	b := req.image.Bounds()
+	write(rw, http.StatusOK, metadataResponse{
+		Image:  uri,
+		Base:   req.base,
+		Width:  b.Dx(),
+		Height: b.Dy(),
+		UID:    req.uid,
+		Order:  req.permutation,
+	})
+}
+
+// renderExtension renders the image in the format of the extension of the
+// path, regardless of the Accept header, for clients that can't set it.
+func (s *service) renderExtension(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	contentType, ok := extensions[p.ByName("ext")]
+	if !ok {
+		writeError(rw, http.StatusNotFound, fmt.Errorf(`unknown extension %q`, p.ByName("ext")))
+		return
+	}
+
+	s.render(rw, r, contentType)
+}
+
+// render generates the image and writes it in the given format, or the one
+// of the description if empty.
+func (s *service) render(rw http.ResponseWriter, r *http.Request, contentType string) {
+	s.writeImage(rw, s.generate(r), contentType)
+}
+
+// writeImage writes the image generated by the request in the given format,
+// or the one of the description if empty, or the error of the request.
+func (s *service) writeImage(rw http.ResponseWriter, req *generateRequest, contentType string) {
+	if req.err != nil {
+		writeError(rw, status(req.err), req.err)
+		return
+	}
+
+	// Clients shuffling the answers need to know where the correct one
+	// landed.
+	if req.shuffle {
+		rw.Header().Set("X-Answer-Order", req.order())
+	}
+	if req.shuffle && req.correct != -1 {
+		rw.Header().Set("X-Correct-Index", strconv.Itoa(req.correct))
 	}
+
+	if s.debugHeaders {
+		b := req.image.Bounds()
+		rw.Header().Set("X-Base", req.base)
+		rw.Header().Set("X-Image-Width", strconv.Itoa(b.Dx()))
+		rw.Header().Set("X-Image-Height", strconv.Itoa(b.Dy()))
+	}
+
+	if contentType == "" {
+		contentType = req.desc.contentType()
+	}
+
+	if len(req.sizes) != 0 {
+		s.writeSizes(rw, req)
+		return
+	}
+
+	// The image is encoded in memory first, so its length is known and
+	// encoding errors can still be reported. Each request in flight holds
+	// its encoded image on top of the decoded one, which is several times
+	// bigger anyway.
+	var body bytes.Buffer
+	err := req.encode(&body, contentType)
+	req.logTimings()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, wrap(err, "encoding image"))
+		return
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	_, _ = body.WriteTo(rw)
+}
+
+// sizesResponse holds the generated image at each requested width, as data
+// URIs keyed by width.
+type sizesResponse struct {
+	Images map[string]string `json:"images"`
+}
+
+// writeSizes downscales the generated image to each of the requested sizes
+// and write them in a single response.
+func (s *service) writeSizes(rw http.ResponseWriter, req *generateRequest) {
+	res := sizesResponse{
+		Images: make(map[string]string),
+	}
+
+	for _, width := range req.sizes {
+		var img image.Image = req.image
+		b := req.image.Bounds()
+		if width < b.Dx() {
+			height := b.Dy() * width / b.Dx()
+			if height < 1 {
+				writeError(rw, http.StatusBadRequest, badRequest(codeInvalidOption, fmt.Errorf(`size %d out of bounds, the image would be %dx%d`, width, width, height)))
+				return
+			}
+			img = resize(req.image, width, height)
+		}
+
+		uri, err := dataURI(img, req.pngCompression)
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		res.Images[strconv.Itoa(width)] = uri
+	}
+
+	write(rw, http.StatusOK, res)
+}
+
+// generate runs the whole generation pipeline for the request. The returned
+// request holds either the generated image or the error that stopped the
+// pipeline.
+func (s *service) generate(r *http.Request) *generateRequest {
+	req := s.newGenerateRequest(r)
 	req.init()
 	req.readPayload()
-	req.getBase()
-	req.getFont()
-	req.writeQuestion()
-	req.writeAnswers()
-	if req.err != nil {
-		writeError(rw, http.StatusInternalServerError, req.err)
+	req.render()
+	return req
+}
+
+// newGenerateRequest prepares a generation request with the dependencies of
+// the service.
+func (s *service) newGenerateRequest(r *http.Request) *generateRequest {
+	return &generateRequest{
+		r:            r,
+		logger:       s.logger,
+		descriptions: s.getDescriptions(),
+		aliases:      s.getAliases(),
+		baseCache:    s.baseCache,
+		placeholder:  s.placeholder,
+		defaultBase:  s.defaultBase,
+		maxTextLen:   s.maxTextLen,
+		fonts:        s.fonts,
+		fallbacks:    s.fallbacks,
+		emoji:        s.emoji,
+
+		caseSensitiveBases:      s.caseSensitiveBases,
+		sanitizeText:            s.sanitizeText,
+		stripMissingGlyphs:      s.stripMissingGlyphs,
+		missingGlyphReplacement: firstRune(s.missingGlyphReplacement),
+
+		watermark:         s.watermark,
+		watermarkPosition: s.watermarkPosition,
+		watermarkMargin:   s.watermarkMargin,
+		watermarkOpacity:  s.watermarkOpacity,
+
+		pngCompression: s.pngCompression,
 	}
-	png.Encode(rw, req.image)
+}
+
+// firstRune returns the first rune of the string, or 0 if it is empty.
+func firstRune(s string) rune {
+	for _, c := range s {
+		return c
+	}
+	return 0
 }
 
 // wrap an error using the provided message and arguments.
@@ -181,8 +1141,90 @@ func wrap(err error, msg string, args ...interface{}) error {
 	return fmt.Errorf("%s: %w", fmt.Sprintf(msg, args...), err)
 }
 
+// badRequestError marks an error as caused by the client, with the code it
+// must be reported with.
+type badRequestError struct {
+	code string
+	err  error
+}
+
+func (e badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e badRequestError) Unwrap() error {
+	return e.err
+}
+
+// badRequest marks the error as caused by the client.
+func badRequest(code string, err error) error {
+	return badRequestError{code: code, err: err}
+}
+
+type upstreamError struct {
+	status int
+	err    error
+}
+
+func (e upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e upstreamError) Unwrap() error {
+	return e.err
+}
+
+// upstream marks the error as caused by a server the service depends on,
+// with the status to respond with: 502 if it failed, 504 if it timed out.
+func upstream(status int, err error) error {
+	return upstreamError{status: status, err: err}
+}
+
+// status returns the HTTP status to respond with for an error.
+func status(err error) int {
+	var bre badRequestError
+	if errors.As(err, &bre) {
+		return http.StatusBadRequest
+	}
+	var ue upstreamError
+	if errors.As(err, &ue) {
+		return ue.status
+	}
+	return http.StatusInternalServerError
+}
+
+// errorCode returns the code to report an error with. Errors caused by the
+// client carry their own code, the others get a generic one depending on the
+// status.
+func errorCode(status int, err error) string {
+	var bre badRequestError
+	if errors.As(err, &bre) {
+		return bre.code
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusBadRequest:
+		return codeInvalidPayload
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return codeUpstreamError
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	case http.StatusTooManyRequests:
+		return codeTooManyRequests
+	default:
+		return codeInternalError
+	}
+}
+
 // write a payload and a status to the ResponseWriter.
 func write(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	raw, err := json.Marshal(payload)
 	if err != nil {
@@ -193,14 +1235,37 @@ func write(w http.ResponseWriter, status int, payload interface{}) {
 
 // write an error and a status to the ResponseWriter.
 func writeError(w http.ResponseWriter, status int, err error) {
-	write(w, status, Error{Err: err.Error()})
+	write(w, status, Error{
+		Err:  err.Error(),
+		Code: errorCode(status, err),
+	})
 }
 
-// Error type for API return values.
+// Error type for API return values. The message is meant for humans, the code
+// for programs.
 type Error struct {
-	Err string `json:"error"`
+	Err  string `json:"error"`
+	Code string `json:"code"`
+	ID   string `json:"id,omitempty"`
 }
 
+// Error codes. They are part of the API, and documented in the README.
+const (
+	codeInternalError      = "internal_error"
+	codeNotFound           = "not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeInvalidPayload     = "invalid_payload"
+	codeInvalidOption      = "invalid_option"
+	codeUnknownBase        = "unknown_base"
+	codeTextTooLong        = "text_too_long"
+	codeImageTooLarge      = "image_too_large"
+	codeUnauthorized       = "unauthorized"
+	codeUpstreamError      = "upstream_error"
+	codeUnavailable        = "unavailable"
+	codeTooManyRequests    = "too_many_requests"
+	codeInvalidDescription = "invalid_description"
+)
+
 // read a payload from a request body.
 func read(r *http.Request, dest interface{}) error {
 	raw, err := ioutil.ReadAll(r.Body)
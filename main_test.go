@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// testDescription is a blank canvas with a wide question block and four
+// answer blocks, drawn with the default font.
+const testDescription = `{
+	"width": 400,
+	"height": 300,
+	"background": "#000000",
+	"question": {"size": 20, "x": 20, "y": 40, "width": 360},
+	"answers": [
+		{"size": 16, "x": 20, "y": 120},
+		{"size": 16, "x": 20, "y": 160},
+		{"size": 16, "x": 20, "y": 200},
+		{"size": 16, "x": 20, "y": 240}
+	]
+}`
+
+// newTestDescription returns the test description, prepared as if it was
+// loaded from a file.
+func newTestDescription(t *testing.T) description {
+	t.Helper()
+
+	var desc description
+	err := json.Unmarshal([]byte(testDescription), &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err = prepareDescription(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// newTestService returns a service with the dependencies init would set up,
+// serving the test description as its default base "test".
+func newTestService(t *testing.T) *service {
+	t.Helper()
+
+	fonts, err := newFontCache(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log15.New()
+	logger.SetHandler(log15.DiscardHandler())
+
+	return &service{
+		defaultBase:      "test",
+		maxBatch:         16,
+		maxImagePixels:   maxDimension * maxDimension,
+		sanitizeText:     true,
+		shutdownTimeout:  time.Minute,
+		logSampleRate:    1,
+		logSlowThreshold: time.Second,
+		logger:           logger,
+		descriptions:     map[string]description{"test": newTestDescription(t)},
+		aliases:          map[string]string{},
+		baseCache:        newBaseCache(),
+		fonts:            fonts,
+		store:            newMemoryStore(time.Hour),
+		jobs:             newJobQueue(1, time.Minute),
+		pngCompression:   png.DefaultCompression,
+	}
+}
+
+func TestBlockWith(t *testing.T) {
+	b := block{Color: "#ffffff", Gradient: &gradient{From: "#ff0000", To: "#0000ff"}}
+
+	highlighted := b.with(style{Color: "#ff8c00"})
+	if highlighted.Color != "#ff8c00" || highlighted.Gradient != nil {
+		t.Errorf("expected the highlight color without gradient, got %q and %+v", highlighted.Color, highlighted.Gradient)
+	}
+
+	boxed := b.with(style{Background: "#000000"})
+	if boxed.Gradient == nil {
+		t.Errorf("expected the gradient to be kept by a background-only style")
+	}
+}
+
+func TestRootErrors(t *testing.T) {
+	s := newTestService(t)
+	missing := newTestDescription(t)
+	missing.Width, missing.Height, missing.Base = 0, 0, "missing.png"
+	s.descriptions["missing"] = missing
+
+	for _, c := range []struct {
+		name   string
+		query  string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "unknown base", body: `{"base": "unknown", "question": "Question ?"}`, status: http.StatusBadRequest, code: codeUnknownBase},
+		{name: "malformed payload", body: `{"question": `, status: http.StatusBadRequest, code: codeInvalidPayload},
+		{name: "invalid answers", body: `{"question": "Question ?", "answers": [1]}`, status: http.StatusBadRequest, code: codeInvalidPayload},
+		{name: "correct out of range", body: `{"question": "Question ?", "answers": ["Oui"], "correct": 4}`, status: http.StatusBadRequest, code: codeInvalidPayload},
+		{name: "invalid option", query: "dpi=zero", body: `{"question": "Question ?"}`, status: http.StatusBadRequest, code: codeInvalidOption},
+		{name: "unreadable base", body: `{"base": "missing", "question": "Question ?"}`, status: http.StatusInternalServerError, code: codeInternalError},
+		{name: "valid", body: `{"question": "Question ?", "answers": ["Oui", "Non"], "correct": 0}`, status: http.StatusOK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/?"+c.query, strings.NewReader(c.body))
+			r.Header.Set("Content-Type", "application/json")
+			rw := httptest.NewRecorder()
+			s.root(rw, r, nil)
+
+			if rw.Code != c.status {
+				t.Fatalf("expected status %d, got %d: %s", c.status, rw.Code, rw.Body)
+			}
+			if c.code == "" {
+				if ct := rw.Header().Get("Content-Type"); ct != "image/png" {
+					t.Errorf("expected a PNG image, got %q", ct)
+				}
+				return
+			}
+
+			var res Error
+			err := json.Unmarshal(rw.Body.Bytes(), &res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Code != c.code {
+				t.Errorf("expected code %q, got %q (%s)", c.code, res.Code, res.Err)
+			}
+		})
+	}
+}
+
+func TestFewerAnswersThanSlots(t *testing.T) {
+	s := newTestService(t)
+	desc := s.descriptions["test"]
+	for i := range desc.Answers {
+		desc.Answers[i].Background = "#ffffff"
+	}
+	s.descriptions["test"] = desc
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"question": "Question ?", "answers": ["Oui", "Non"]}`))
+	r.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+	s.root(rw, r, nil)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rw.Code, rw.Body)
+	}
+	img, err := png.Decode(rw.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The slots are 40 pixels apart, their texts rising about 16 pixels
+	// above their baseline, and their boxes 4 pixels further.
+	for i, a := range desc.Answers {
+		y := a.Y.resolve(desc.Height)
+		blank := true
+		for py := y - 25; py < y+10; py++ {
+			for px := 0; px < desc.Width; px++ {
+				if r, g, b, _ := img.At(px, py).RGBA(); r|g|b != 0 {
+					blank = false
+				}
+			}
+		}
+		if expected := i >= 2; blank != expected {
+			t.Errorf("slot %d: expected blank to be %v", i, expected)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		duration time.Duration
+		status   int
+	}{
+		{name: "completed", duration: 100 * time.Millisecond, status: http.StatusOK},
+		{name: "dropped", duration: 1500 * time.Millisecond},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestService(t)
+			s.shutdownTimeout = 500 * time.Millisecond
+
+			started := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(c.duration)
+				rw.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			res := make(chan int, 1)
+			go func() {
+				r, err := http.Get(server.URL)
+				if err != nil {
+					res <- 0
+					return
+				}
+				r.Body.Close()
+				res <- r.StatusCode
+			}()
+
+			<-started
+			start := time.Now()
+			s.shutdown(nil, server.Config)
+			if elapsed := time.Since(start); elapsed > s.shutdownTimeout+time.Second {
+				t.Errorf("expected the shutdown to take at most %v, took %v", s.shutdownTimeout, elapsed)
+			}
+
+			if status := <-res; status != c.status {
+				t.Errorf("expected status %d, got %d", c.status, status)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// payload is the text content of a generation request.
+type payload struct {
+	Base     baseName `json:"base"`
+	Question string   `json:"question"`
+	Answers  answers  `json:"answers"`
+
+	// Correct is the index of the answer to highlight, if any, and
+	// Highlight the color of its text, overriding the description's.
+	Correct   *int   `json:"correct"`
+	Highlight string `json:"highlight"`
+
+	// Shuffle draws the answers in an order given by the seed, like the
+	// shuffle and seed options, which take precedence.
+	Shuffle bool   `json:"shuffle,omitempty"`
+	Seed    *int64 `json:"seed,omitempty"`
+}
+
+// baseName is the name of a base, given as a string or, for the aliases
+// that are numbers, as a number.
+type baseName string
+
+func (n *baseName) UnmarshalJSON(raw []byte) error {
+	var s string
+	err := json.Unmarshal(raw, &s)
+	if err == nil {
+		*n = baseName(s)
+		return nil
+	}
+
+	var num json.Number
+	err = json.Unmarshal(raw, &num)
+	if err != nil {
+		return fmt.Errorf(`base must be a string or a number`)
+	}
+	*n = baseName(num.String())
+	return nil
+}
+
+// answers are given either as a list filling the answer blocks in order, or
+// as an object filling the answer blocks by name.
+type answers struct {
+	list  []answer
+	named map[string]answer
+}
+
+func (a *answers) UnmarshalJSON(raw []byte) error {
+	err := json.Unmarshal(raw, &a.list)
+	if err == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(raw, &a.named)
+	if err != nil {
+		return fmt.Errorf(`answers must be a list or an object of answers`)
+	}
+	return nil
+}
+
+// answer is the text of an answer, with optional overrides of the style of
+// its block. It is given either as a string, or as an object.
+type answer struct {
+	Text  string  `json:"text"`
+	Color string  `json:"color"`
+	Size  float64 `json:"size"`
+}
+
+func (a *answer) UnmarshalJSON(raw []byte) error {
+	err := json.Unmarshal(raw, &a.Text)
+	if err == nil {
+		return nil
+	}
+
+	// The alias has the fields of answer without its methods, to decode
+	// the object form without recursing.
+	type alias answer
+	err = json.Unmarshal(raw, (*alias)(a))
+	if err != nil {
+		return fmt.Errorf(`answer must be a string or an object`)
+	}
+	return nil
+}
+
+// check returns an error if the overrides of the answer are invalid.
+func (a answer) check() error {
+	if a.Color != "" {
+		_, err := parseColor(a.Color)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.Size < 0 || a.Size > maxDimension {
+		return fmt.Errorf(`invalid size %v, must be between 0 and %d`, a.Size, maxDimension)
+	}
+	return nil
+}
+
+// apply returns a copy of the block with the overrides of the answer.
+func (a answer) apply(b block) block {
+	if a.Color != "" {
+		b.Color = a.Color
+		b.Gradient = nil
+	}
+	if a.Size != 0 {
+		b.Size = a.Size
+	}
+	return b
+}
+
+// resolve returns the answers in the order of the blocks of the description.
+// Blocks without a named answer are left blank.
+func (a answers) resolve(desc description) ([]answer, error) {
+	if n := len(a.list) + len(a.named); n > desc.maxAnswers() {
+		return nil, fmt.Errorf(`too many answers, the base accepts at most %d`, desc.maxAnswers())
+	}
+
+	if len(a.named) == 0 {
+		return a.list, nil
+	}
+
+	if len(a.list) != 0 {
+		return nil, fmt.Errorf(`answers can't be both positional and named`)
+	}
+
+	list := make([]answer, len(desc.Answers))
+	for name, answer := range a.named {
+		i := desc.answerIndex(name)
+		if i < 0 {
+			return nil, fmt.Errorf(`unknown answer %q`, name)
+		}
+		list[i] = answer
+	}
+	return list, nil
+}
+
+// maxFormMemory is the size of multipart forms kept in memory, the rest being
+// stored in temporary files.
+const maxFormMemory = 1 << 20
+
+// mediaType returns the media type of the request body, without parameters.
+func mediaType(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType
+}
+
+// formPayload reads the payload from form values. Answers are given as
+// repeated answers or answer fields, or by name as answers[name] fields.
+func formPayload(form url.Values) (payload, error) {
+	p := payload{
+		Base:      baseName(form.Get("base")),
+		Question:  form.Get("question"),
+		Highlight: form.Get("highlight"),
+		Answers: answers{
+			named: make(map[string]answer),
+		},
+	}
+
+	for _, key := range []string{"answers", "answer"} {
+		for _, text := range form[key] {
+			p.Answers.list = append(p.Answers.list, answer{Text: text})
+		}
+	}
+
+	for key := range form {
+		if !strings.HasPrefix(key, "answers[") || !strings.HasSuffix(key, "]") {
+			continue
+		}
+		p.Answers.named[strings.TrimSuffix(strings.TrimPrefix(key, "answers["), "]")] = answer{Text: form.Get(key)}
+	}
+
+	if raw := form.Get("correct"); raw != "" {
+		correct, err := strconv.Atoi(raw)
+		if err != nil {
+			return p, fmt.Errorf(`invalid correct answer %q, must be an index`, raw)
+		}
+		p.Correct = &correct
+	}
+
+	return p, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// maxColors is the largest palette a PNG image can have.
+const maxColors = 256
+
+// colorCount is a color of an image, and its number of pixels.
+type colorCount struct {
+	c color.RGBA
+	n int
+}
+
+// colorBox is a set of colors, represented by a single color of the palette.
+type colorBox []colorCount
+
+// quantize reduces the image to a palette of at most n colors, chosen by
+// median cut: the set of colors is split in two at its median along its
+// widest channel, then the widest of the sets, and so on until there are n
+// sets, each represented by its average color. Images with few colors, such
+// as flat templates, are much smaller encoded as paletted PNG images, but
+// photographs lose their gradients.
+func quantize(img *image.RGBA, n int) *image.Paletted {
+	counts := make(map[color.RGBA]int)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			counts[img.RGBAAt(x, y)]++
+		}
+	}
+
+	all := make(colorBox, 0, len(counts))
+	for c, count := range counts {
+		all = append(all, colorCount{c: c, n: count})
+	}
+
+	// The ranges of the boxes are kept along them, as computing them for
+	// every box at each split is slow for images of many colors.
+	boxes := []colorBox{all}
+	_, r := all.widest()
+	ranges := []uint8{r}
+	for len(boxes) < n {
+		i := -1
+		for j, box := range boxes {
+			if len(box) > 1 && (i == -1 || ranges[j] > ranges[i]) {
+				i = j
+			}
+		}
+		if i == -1 {
+			break
+		}
+
+		low, high := boxes[i].split()
+		_, lowRange := low.widest()
+		_, highRange := high.widest()
+		boxes[i], ranges[i] = low, lowRange
+		boxes = append(boxes, high)
+		ranges = append(ranges, highRange)
+	}
+
+	palette := make(color.Palette, len(boxes))
+	index := make(map[color.RGBA]uint8, len(counts))
+	for i, box := range boxes {
+		palette[i] = box.average()
+		for _, e := range box {
+			index[e.c] = uint8(i)
+		}
+	}
+
+	out := image.NewPaletted(b, palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.SetColorIndex(x, y, index[img.RGBAAt(x, y)])
+		}
+	}
+	return out
+}
+
+// channel returns the ith channel of the color, in RGBA order.
+func channel(c color.RGBA, i int) uint8 {
+	switch i {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	default:
+		return c.A
+	}
+}
+
+// widest returns the channel of the box whose values spread the most, and
+// their range.
+func (b colorBox) widest() (int, uint8) {
+	best, bestRange := 0, uint8(0)
+	for i := 0; i < 4; i++ {
+		min, max := uint8(255), uint8(0)
+		for _, e := range b {
+			v := channel(e.c, i)
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if max >= min && max-min > bestRange {
+			best, bestRange = i, max-min
+		}
+	}
+	return best, bestRange
+}
+
+// split cuts the box in two at the median pixel along its widest channel.
+// Both halves have at least one color.
+func (b colorBox) split() (colorBox, colorBox) {
+	ch, _ := b.widest()
+	sort.Slice(b, func(i, j int) bool {
+		return channel(b[i].c, ch) < channel(b[j].c, ch)
+	})
+
+	total := 0
+	for _, e := range b {
+		total += e.n
+	}
+
+	cut, seen := 1, b[0].n
+	for cut < len(b)-1 && seen < total/2 {
+		seen += b[cut].n
+		cut++
+	}
+	return b[:cut], b[cut:]
+}
+
+// average returns the average color of the pixels of the box.
+func (b colorBox) average() color.RGBA {
+	var r, g, bl, a, total int
+	for _, e := range b {
+		r += int(e.c.R) * e.n
+		g += int(e.c.G) * e.n
+		bl += int(e.c.B) * e.n
+		a += int(e.c.A) * e.n
+		total += e.n
+	}
+	return color.RGBA{
+		R: uint8((r + total/2) / total),
+		G: uint8((g + total/2) / total),
+		B: uint8((bl + total/2) / total),
+		A: uint8((a + total/2) / total),
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestQuantize(t *testing.T) {
+	// A gradient of 256 grays, and a few colors.
+	img := image.NewRGBA(image.Rect(0, 0, 256, 4))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 4; y++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(x), B: uint8(x), A: 255})
+		}
+	}
+
+	for _, n := range []int{2, 16, 256} {
+		out := quantize(img, n)
+		if len(out.Palette) > n {
+			t.Errorf("%d colors: got a palette of %d colors", n, len(out.Palette))
+		}
+		if out.Bounds() != img.Bounds() {
+			t.Errorf("%d colors: expected bounds %v, got %v", n, img.Bounds(), out.Bounds())
+		}
+	}
+
+	// Images with fewer colors than the palette keep them exactly.
+	flat := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	colors := []color.RGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}}
+	for x, c := range colors {
+		flat.SetRGBA(x, 0, c)
+	}
+	out := quantize(flat, 16)
+	if len(out.Palette) != len(colors) {
+		t.Errorf("expected a palette of %d colors, got %d", len(colors), len(out.Palette))
+	}
+	for x, c := range colors {
+		if got := out.At(x, 0); got != c {
+			t.Errorf("pixel %d: expected %v, got %v", x, c, got)
+		}
+	}
+}
+
+func TestEncodeColors(t *testing.T) {
+	s := newTestService(t)
+	desc := s.descriptions["test"]
+	desc.Question.Gradient = &gradient{From: "#ff0000", To: "#0000ff", Direction: gradientHorizontal}
+	desc.Question.Background = "#ffffff"
+	s.descriptions["test"] = desc
+
+	p := payload{Question: "Quelle est la capitale ?", Answers: answers{list: []answer{{Text: "Paris"}, {Text: "Lyon"}}}}
+	encoded := func(query string) []byte {
+		req := generate(t, s, query, p)
+		if req.err != nil {
+			t.Fatal(req.err)
+		}
+		var buf bytes.Buffer
+		err := req.encode(&buf, "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	full := encoded("")
+	paletted := encoded("colors=8")
+	if len(paletted) >= len(full) {
+		t.Errorf("expected the paletted image to be smaller than %d bytes, got %d", len(full), len(paletted))
+	}
+
+	img, err := png.Decode(bytes.NewReader(paletted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paletted8, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("expected a paletted image, got %T", img)
+	}
+	if len(paletted8.Palette) > 8 {
+		t.Errorf("expected at most 8 colors, got %d", len(paletted8.Palette))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// renderSamples renders an image of each description with placeholder texts,
+// through the whole pipeline down to the encoding, and returns the errors of
+// the descriptions failing, in the order of their names.
+func (s *service) renderSamples() []error {
+	descriptions := s.getDescriptions()
+	var names []string
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		err := s.renderSample(name, descriptions[name])
+		if err != nil {
+			errs = append(errs, wrap(err, "description %q", name))
+		}
+	}
+	return errs
+}
+
+// renderSample renders an image of the description with placeholder texts,
+// filling all its answers and highlighting the first one.
+func (s *service) renderSample(name string, desc description) error {
+	r, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err != nil {
+		return err
+	}
+
+	req := s.newGenerateRequest(r)
+	req.init()
+	req.payload = payload{
+		Base:     baseName(name),
+		Question: "Question ?",
+	}
+	for i := 0; i < desc.maxAnswers(); i++ {
+		req.payload.Answers.list = append(req.payload.Answers.list, answer{Text: fmt.Sprintf("Réponse %d", i+1)})
+	}
+	if desc.maxAnswers() != 0 {
+		correct := 0
+		req.payload.Correct = &correct
+	}
+
+	req.render()
+	if req.err != nil {
+		return req.err
+	}
+	return req.encode(ioutil.Discard, desc.contentType())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// maxShadowBlur is the maximum blur radius of the shadows of blocks.
+const maxShadowBlur = 64
+
+// drawShadow draws the shadow of the lines of the block, under them. The text
+// is drawn as a mask at the offset of the shadow and blurred, then the color
+// of the shadow is drawn through it.
+func (r *generateRequest) drawShadow(b block, lines []textLine) {
+	mask := image.NewAlpha(r.image.Bounds())
+	offset := fixed.Point26_6{
+		X: fixed.Int26_6(b.ShadowOffsetX * r.dpi * 64),
+		Y: fixed.Int26_6(b.ShadowOffsetY * r.dpi * 64),
+	}
+	drawLines(mask, image.Opaque, lines, offset)
+
+	if radius := int(b.ShadowBlur*r.dpi + 0.5); radius > 0 {
+		boxBlur(mask, radius)
+	}
+
+	c := image.NewUniform(fade(parseColorOr(b.ShadowColor, color.Black), b.opacity()))
+	draw.DrawMask(r.image, r.image.Bounds(), c, image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+// boxBlur blurs the mask in place, averaging each pixel with its neighbours
+// up to radius pixels away, horizontally then vertically.
+func boxBlur(m *image.Alpha, radius int) {
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	tmp := make([]uint8, w+h)
+	for y := 0; y < h; y++ {
+		blurLine(m.Pix, y*m.Stride, 1, w, radius, tmp)
+	}
+	for x := 0; x < w; x++ {
+		blurLine(m.Pix, x, m.Stride, h, radius, tmp)
+	}
+}
+
+// blurLine averages the n values of pix starting at start and stride apart
+// over a sliding window of 2*radius+1 values, those beyond the ends counting
+// as transparent. The buffer holds the original values while they are
+// overwritten.
+func blurLine(pix []uint8, start, stride, n, radius int, buf []uint8) {
+	for i := 0; i < n; i++ {
+		buf[i] = pix[start+i*stride]
+	}
+
+	size := 2*radius + 1
+	sum := 0
+	for i := 0; i < radius && i < n; i++ {
+		sum += int(buf[i])
+	}
+	for i := 0; i < n; i++ {
+		if j := i + radius; j < n {
+			sum += int(buf[j])
+		}
+		if j := i - radius - 1; j >= 0 {
+			sum -= int(buf[j])
+		}
+		pix[start+i*stride] = uint8(sum / size)
+	}
+}
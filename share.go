@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/xid"
+)
+
+// errNotStored is returned by stores when no image exists for an id.
+var errNotStored = errors.New("image not found")
+
+// store persists shared images by id. Images are also indexed by the hash of
+// their content, so identical images can be stored once.
+type store interface {
+	put(id string, data []byte) error
+	get(id string) ([]byte, error)
+	find(hash string) (string, error)
+}
+
+// contentHash returns the hash of the image indexing it in stores.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// memoryStore keeps shared images in memory until their TTL expires.
+type memoryStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	hashes  map[string]string
+}
+
+type memoryEntry struct {
+	data    []byte
+	hash    string
+	expires time.Time
+}
+
+func newMemoryStore(ttl time.Duration) *memoryStore {
+	return &memoryStore{
+		ttl:     ttl,
+		entries: make(map[string]memoryEntry),
+		hashes:  make(map[string]string),
+	}
+}
+
+// put stores the image, and evicts the expired ones on the way.
+func (s *memoryStore) put(id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range s.entries {
+		if s.expired(e, now) {
+			delete(s.entries, k)
+			delete(s.hashes, e.hash)
+		}
+	}
+
+	hash := contentHash(data)
+	s.entries[id] = memoryEntry{
+		data:    data,
+		hash:    hash,
+		expires: now.Add(s.ttl),
+	}
+	s.hashes[hash] = id
+	return nil
+}
+
+func (s *memoryStore) get(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok || s.expired(e, time.Now()) {
+		return nil, errNotStored
+	}
+	return e.data, nil
+}
+
+func (s *memoryStore) find(hash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.hashes[hash]
+	if !ok || s.expired(s.entries[id], time.Now()) {
+		return "", errNotStored
+	}
+	return id, nil
+}
+
+func (s *memoryStore) expired(e memoryEntry, now time.Time) bool {
+	return s.ttl > 0 && now.After(e.expires)
+}
+
+// diskStore persists shared images as files in a directory.
+type diskStore struct {
+	dir string
+}
+
+// put writes the image, and indexes it by a file named after its hash in the
+// hashes subdirectory, holding its id.
+func (s diskStore) put(id string, data []byte) error {
+	err := ioutil.WriteFile(s.path(id), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Join(s.dir, "hashes"), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, "hashes", contentHash(data)), []byte(id), 0644)
+}
+
+func (s diskStore) get(id string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, errNotStored
+	}
+	return data, err
+}
+
+func (s diskStore) find(hash string) (string, error) {
+	id, err := ioutil.ReadFile(filepath.Join(s.dir, "hashes", hash))
+	if os.IsNotExist(err) {
+		return "", errNotStored
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The image may have been removed since.
+	_, err = os.Stat(s.path(string(id)))
+	if os.IsNotExist(err) {
+		return "", errNotStored
+	}
+	return string(id), err
+}
+
+func (s diskStore) path(id string) string {
+	return filepath.Join(s.dir, id+".png")
+}
+
+// shareResponse is returned when an image has been shared.
+type shareResponse struct {
+	URL string `json:"url"`
+}
+
+// share generates an image and stores it so it can be served later by its
+// short URL.
+func (s *service) share(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := s.generate(r)
+	if req.err != nil {
+		writeError(rw, status(req.err), req.err)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := req.encode(&buf, "image/png")
+	req.logTimings()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, wrap(err, "encoding image"))
+		return
+	}
+
+	id, created, err := s.storeImage(req.uid, buf.Bytes())
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, wrap(err, "storing image"))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	write(rw, status, shareResponse{URL: "/i/" + id})
+}
+
+// storeImage stores the image under the id, unless an identical one is
+// already stored. It returns the id of the stored image, and whether it was
+// created.
+func (s *service) storeImage(id string, data []byte) (string, bool, error) {
+	existing, err := s.store.find(contentHash(data))
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, errNotStored) {
+		return "", false, wrap(err, "looking for identical image")
+	}
+
+	err = s.store.put(id, data)
+	if err != nil {
+		return "", false, err
+	}
+	return id, true, nil
+}
+
+// shared serves a previously shared image.
+func (s *service) shared(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+
+	// Ids are generated by xid, so anything else can't have been stored.
+	// This also protects the disk store against path traversal.
+	_, err := xid.FromString(id)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, fmt.Errorf(`image %q not found`, id))
+		return
+	}
+
+	data, err := s.store.get(id)
+	if errors.Is(err, errNotStored) {
+		writeError(rw, http.StatusNotFound, fmt.Errorf(`image %q not found`, id))
+		return
+	}
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, wrap(err, "reading image"))
+		return
+	}
+
+	// A shared image never changes once stored.
+	rw.Header().Set("Content-Type", "image/png")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(data)
+}
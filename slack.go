@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// slackMaxAge is the maximum age of a Slack request, to prevent replays.
+const slackMaxAge = 5 * time.Minute
+
+// slackMessage is the response to a slash command.
+type slackMessage struct {
+	ResponseType string       `json:"response_type"`
+	Text         string       `json:"text,omitempty"`
+	Blocks       []slackBlock `json:"blocks,omitempty"`
+}
+
+// slackBlock is an image block of a Slack message.
+type slackBlock struct {
+	Type     string `json:"type"`
+	ImageURL string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+// slack handles Slack slash commands, whose text is the base followed by the
+// question and the answers, quoted when they contain spaces:
+//
+//	/meme qvgdm "Who wrote this?" "Me" "You"
+//
+// The image is shared, and posted in the channel. Errors are only shown to
+// the user, as Slack expects.
+func (s *service) slack(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "reading body")))
+		return
+	}
+
+	err = verifySlack(r.Header, body, s.slackSigningSecret, time.Now())
+	if err != nil {
+		writeError(rw, http.StatusUnauthorized, err)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, badRequest(codeInvalidPayload, wrap(err, "parsing form")))
+		return
+	}
+
+	args, err := splitArgs(form.Get("text"))
+	if err != nil || len(args) < 2 {
+		write(rw, http.StatusOK, slackMessage{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf(`Usage: %s base "question" "answer" ...`, form.Get("command")),
+		})
+		return
+	}
+
+	req := s.newGenerateRequest(r)
+	req.init()
+	req.payload = payload{
+		Base:     baseName(args[0]),
+		Question: args[1],
+	}
+	for _, text := range args[2:] {
+		req.payload.Answers.list = append(req.payload.Answers.list, answer{Text: text})
+	}
+	req.render()
+
+	var buf bytes.Buffer
+	if req.err == nil {
+		req.err = req.encode(&buf, "image/png")
+		req.logTimings()
+	}
+	id := req.uid
+	if req.err == nil {
+		id, _, req.err = s.storeImage(req.uid, buf.Bytes())
+	}
+	if req.err != nil {
+		req.logger.Error("generating slack image", "err", req.err)
+		write(rw, http.StatusOK, slackMessage{
+			ResponseType: "ephemeral",
+			Text:         "Couldn't generate the image: " + req.err.Error(),
+		})
+		return
+	}
+
+	write(rw, http.StatusOK, slackMessage{
+		ResponseType: "in_channel",
+		Blocks: []slackBlock{{
+			Type:     "image",
+			ImageURL: strings.TrimSuffix(s.publicURL, "/") + "/i/" + id,
+			AltText:  req.question,
+		}},
+	})
+}
+
+// verifySlack checks the signature of a Slack request, as described in
+// https://api.slack.com/authentication/verifying-requests-from-slack.
+func verifySlack(header http.Header, body []byte, secret string, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid Slack request timestamp")
+	}
+
+	age := now.Sub(time.Unix(ts, 0))
+	if age > slackMaxAge || age < -slackMaxAge {
+		return errors.New("expired Slack request")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return errors.New("invalid Slack signature")
+	}
+	return nil
+}
+
+// splitArgs splits a command line on spaces, except inside quotes. Both
+// straight and curly double quotes are accepted, as clients like to replace
+// the former by the latter.
+func splitArgs(text string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg, quoted := false, false
+
+	for _, c := range text {
+		switch {
+		case c == '"' || c == '“' || c == '”':
+			quoted = !quoted
+			inArg = true
+		case unicode.IsSpace(c) && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+			}
+			inArg = false
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// maxStrokeWidth is the maximum stroke width of blocks, as the cost of the
+// stroke grows with its square.
+const maxStrokeWidth = 16
+
+// drawStroke draws the outline of the lines of the block, spreading
+// StrokeWidth pixels around the glyphs. The text is drawn as a mask, which is
+// dilated, then the color of the stroke is drawn through it. Hollow blocks
+// only get the outline, the inside of the glyphs being cut out of the mask.
+func (r *generateRequest) drawStroke(b block, lines []textLine) {
+	mask := image.NewAlpha(r.image.Bounds())
+	drawLines(mask, image.Opaque, lines, fixed.Point26_6{})
+
+	radius := int(b.StrokeWidth*r.dpi + 0.5)
+	if radius < 1 {
+		radius = 1
+	}
+	outline := dilate(mask, radius)
+
+	if b.Hollow {
+		for i, v := range mask.Pix {
+			if outline.Pix[i] > v {
+				outline.Pix[i] -= v
+			} else {
+				outline.Pix[i] = 0
+			}
+		}
+	}
+
+	c := image.NewUniform(fade(parseColorOr(b.StrokeColor, color.Black), b.opacity()))
+	draw.DrawMask(r.image, r.image.Bounds(), c, image.Point{}, outline, image.Point{}, draw.Over)
+}
+
+// dilate returns the mask grown by radius pixels in every direction, each
+// pixel taking the highest value of the pixels of the disk around it. Only
+// the pixels of the mask that aren't transparent are spread, which are few for
+// texts.
+func dilate(m *image.Alpha, radius int) *image.Alpha {
+	var disk []image.Point
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx*dx+dy*dy <= radius*radius {
+				disk = append(disk, image.Pt(dx, dy))
+			}
+		}
+	}
+
+	b := m.Bounds()
+	out := image.NewAlpha(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := m.Pix[m.PixOffset(x, y)]
+			if v == 0 {
+				continue
+			}
+			for _, d := range disk {
+				p := image.Pt(x+d.X, y+d.Y)
+				if !p.In(b) {
+					continue
+				}
+				if i := out.PixOffset(p.X, p.Y); out.Pix[i] < v {
+					out.Pix[i] = v
+				}
+			}
+		}
+	}
+	return out
+}
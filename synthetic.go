@@ -0,0 +1,99 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// italicSlant is the horizontal shift of synthetic italic glyphs for each
+// pixel above the baseline, for a slant of about 12 degrees.
+const italicSlant = 0.2
+
+// styledFace draws the glyphs of a face in synthetic bold or italic, for fonts
+// without those styles: bold glyphs are smeared horizontally, and italic ones
+// sheared.
+type styledFace struct {
+	font.Face
+	bold   int
+	italic bool
+}
+
+// newStyledFace returns the face styled as the block, or the face itself if
+// the block isn't styled. The glyphs are emboldened by about a 24th of the
+// size of the text.
+func newStyledFace(f font.Face, b block) font.Face {
+	if !b.Bold && !b.Italic {
+		return f
+	}
+
+	s := &styledFace{Face: f, italic: b.Italic}
+	if b.Bold {
+		s.bold = int(math.Max(1, math.Round(b.Size/24)))
+	}
+	return s
+}
+
+func (f *styledFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	dr, mask, maskp, advance, ok := f.Face.Glyph(dot, r)
+	if !ok {
+		return dr, mask, maskp, advance, ok
+	}
+	advance += fixed.I(f.bold)
+	if dr.Empty() {
+		return dr, mask, maskp, advance, ok
+	}
+
+	baseline := dot.Y.Round()
+	out := image.Rect(dr.Min.X+f.shift(dr.Max.Y-1-baseline), dr.Min.Y, dr.Max.X+f.shift(dr.Min.Y-baseline)+f.bold, dr.Max.Y)
+	if out.Min.X > dr.Min.X {
+		out.Min.X = dr.Min.X
+	}
+
+	// The mask of the face may be reused by its next glyph, so the styled
+	// glyph is drawn in a mask of its own.
+	dst := image.NewAlpha(out)
+	for y := dr.Min.Y; y < dr.Max.Y; y++ {
+		s := f.shift(y - baseline)
+		for x := dr.Min.X; x < dr.Max.X; x++ {
+			_, _, _, a := mask.At(maskp.X+x-dr.Min.X, maskp.Y+y-dr.Min.Y).RGBA()
+			if a == 0 {
+				continue
+			}
+			for k := 0; k <= f.bold; k++ {
+				i := dst.PixOffset(x+s+k, y)
+				if uint8(a>>8) > dst.Pix[i] {
+					dst.Pix[i] = uint8(a >> 8)
+				}
+			}
+		}
+	}
+	return out, dst, out.Min, advance, true
+}
+
+func (f *styledFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	bounds, advance, ok := f.Face.GlyphBounds(r)
+	if !ok {
+		return bounds, advance, ok
+	}
+
+	bounds.Max.X += fixed.I(f.bold + f.shift(bounds.Min.Y.Floor()))
+	bounds.Min.X += fixed.I(f.shift(bounds.Max.Y.Ceil()))
+	return bounds, advance + fixed.I(f.bold), true
+}
+
+func (f *styledFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	advance, ok := f.Face.GlyphAdvance(r)
+	return advance + fixed.I(f.bold), ok
+}
+
+// shift returns the horizontal shift of the row of pixels at y from the
+// baseline, negative above it.
+func (f *styledFace) shift(y int) int {
+	if !f.italic {
+		return 0
+	}
+	return int(math.Round(float64(-y) * italicSlant))
+}
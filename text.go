@@ -0,0 +1,215 @@
+package main
+
+import (
+	"image"
+	"strings"
+	"unicode"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ellipsis ends the texts truncated to fit their block.
+const ellipsis = "…"
+
+// Writing directions of a block.
+const (
+	directionAuto = "auto"
+	directionLTR  = "ltr"
+	directionRTL  = "rtl"
+)
+
+// rtlScripts are the scripts written from right to left.
+var rtlScripts = []*unicode.RangeTable{
+	unicode.Arabic,
+	unicode.Hebrew,
+	unicode.Syriac,
+	unicode.Thaana,
+	unicode.Nko,
+}
+
+// visualOrder returns the text in the order its runes must be drawn, given the
+// direction of the block. Right-to-left text is reversed, but runs of
+// left-to-right runes (latin words, numbers) inside it keep their order. This
+// is no replacement for a full bidirectional algorithm nor for shaping, but
+// is enough to make simple right-to-left captions readable.
+func visualOrder(text string, direction string) string {
+	switch direction {
+	case directionLTR:
+		return text
+	case directionRTL:
+	default:
+		if !isRTL(text) {
+			return text
+		}
+	}
+
+	// Split the text in clusters of a base rune followed by its combining
+	// marks, so marks stay attached to their base once reversed.
+	var clusters [][]rune
+	for _, c := range text {
+		if len(clusters) != 0 && unicode.Is(unicode.Mn, c) {
+			clusters[len(clusters)-1] = append(clusters[len(clusters)-1], c)
+			continue
+		}
+		clusters = append(clusters, []rune{c})
+	}
+
+	for i, j := 0, len(clusters)-1; i < j; i, j = i+1, j-1 {
+		clusters[i], clusters[j] = clusters[j], clusters[i]
+	}
+
+	// Restore the order of the left-to-right runs.
+	for i := 0; i < len(clusters); {
+		if !isLTR(clusters[i][0]) {
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(clusters) && isLTR(clusters[j][0]) {
+			j++
+		}
+
+		for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+			clusters[a], clusters[b] = clusters[b], clusters[a]
+		}
+		i = j
+	}
+
+	var out []rune
+	for _, c := range clusters {
+		out = append(out, c...)
+	}
+	return string(out)
+}
+
+// isRTL returns whether the first strongly directional rune of the text
+// belongs to a right-to-left script.
+func isRTL(text string) bool {
+	for _, c := range text {
+		if unicode.In(c, rtlScripts...) {
+			return true
+		}
+		if isLTR(c) {
+			return false
+		}
+	}
+	return false
+}
+
+// isLTR returns whether the rune is a strongly left-to-right rune, or a digit.
+func isLTR(c rune) bool {
+	if unicode.In(c, rtlScripts...) {
+		return false
+	}
+	return unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// textLine is a line of text, made of runs, starting at the dot.
+type textLine struct {
+	runs  []textRun
+	dot   fixed.Point26_6
+	width fixed.Int26_6
+}
+
+// textBox returns the bounding box of the lines, from the ascent of the first
+// one to the descent of the last one.
+func textBox(lines []textLine, metrics font.Metrics) image.Rectangle {
+	var box image.Rectangle
+	for _, l := range lines {
+		box = box.Union(image.Rect(
+			l.dot.X.Floor(),
+			(l.dot.Y - metrics.Ascent).Floor(),
+			(l.dot.X + l.width).Ceil(),
+			(l.dot.Y + metrics.Descent).Ceil(),
+		))
+	}
+	return box
+}
+
+// textRun is a part of a text drawn with a single face.
+type textRun struct {
+	face font.Face
+	text string
+
+	// spacing is added after each character, which are then drawn one at a
+	// time.
+	spacing fixed.Int26_6
+}
+
+// draw the run with the drawer, advancing its dot.
+func (run textRun) draw(d *font.Drawer) {
+	if e, ok := run.face.(*emojiFace); ok {
+		e.draw(d.Dst, &d.Dot, run.text, run.spacing)
+		return
+	}
+
+	if run.spacing == 0 {
+		d.DrawString(run.text)
+		return
+	}
+
+	for _, c := range run.text {
+		d.DrawString(string(c))
+		d.Dot.X += run.spacing
+	}
+}
+
+// measure returns the advance of the run once drawn.
+func (run textRun) measure() fixed.Int26_6 {
+	if run.spacing == 0 {
+		return font.MeasureString(run.face, run.text)
+	}
+
+	var width fixed.Int26_6
+	for _, c := range run.text {
+		width += font.MeasureString(run.face, string(c)) + run.spacing
+	}
+	return width
+}
+
+// measureRuns returns the advance of the runs once drawn. The spacing after
+// the last character isn't part of the text.
+func measureRuns(runs []textRun) fixed.Int26_6 {
+	var width fixed.Int26_6
+	for _, run := range runs {
+		width += run.measure()
+	}
+	if len(runs) != 0 {
+		width -= runs[len(runs)-1].spacing
+	}
+	return width
+}
+
+// glyphFont returns the index of the first font having a glyph for the rune,
+// and whether there is one.
+func glyphFont(fonts []*truetype.Font, c rune) (int, bool) {
+	for i, f := range fonts {
+		if f.Index(c) != 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// sanitize normalizes the text to NFC, so characters are drawn the same
+// whatever their encoding, and removes the control characters but line
+// breaks. Tabs are replaced by spaces.
+func sanitize(text string) string {
+	text = strings.Replace(norm.NFC.String(text), "\r\n", "\n", -1)
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c == '\n':
+			return c
+		case c == '\t':
+			return ' '
+		case unicode.IsControl(c):
+			return -1
+		default:
+			return c
+		}
+	}, text)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	for _, c := range []struct {
+		text     string
+		expected string
+	}{
+		{text: "Cafe\u0301", expected: "Café"},
+		{text: "A\u030a", expected: "Å"},
+		{text: "De\u0301ja\u0300 vu", expected: "Déjà vu"},
+		{text: "a\tb", expected: "a b"},
+		{text: "a\r\nb", expected: "a\nb"},
+		{text: "a\x00b\x1bc", expected: "abc"},
+	} {
+		got := sanitize(c.text)
+		if got != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.text, c.expected, got)
+		}
+	}
+}
+
+func TestDecomposedText(t *testing.T) {
+	s := newTestService(t)
+
+	composed := generate(t, s, "", payload{Question: "Café à l'été", Answers: answers{list: []answer{{Text: "Éric"}}}})
+	decomposed := generate(t, s, "", payload{Question: "Cafe\u0301 a\u0300 l'e\u0301te\u0301", Answers: answers{list: []answer{{Text: "E\u0301ric"}}}})
+	for _, req := range []*generateRequest{composed, decomposed} {
+		if req.err != nil {
+			t.Fatal(req.err)
+		}
+	}
+
+	if composed.question != decomposed.question {
+		t.Errorf("expected the question %q, got %q", composed.question, decomposed.question)
+	}
+	if !bytes.Equal(composed.image.Pix, decomposed.image.Pix) {
+		t.Errorf("expected the decomposed texts to be drawn like the composed ones")
+	}
+}
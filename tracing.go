@@ -0,0 +1,71 @@
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/plugin/othttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracerName is the name of the tracer used for the spans of the service.
+const tracerName = "github.com/elwinar/votrederniermot"
+
+// initTracing registers the OTLP exporter as global trace provider. Without
+// an endpoint the global provider is left alone, and spans are no-ops.
+func (s *service) initTracing() error {
+	if s.otlpEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(s.otlpEndpoint))
+	if err != nil {
+		return wrap(err, "creating OTLP exporter")
+	}
+
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.New(kv.String("service.name", "votrederniermot"))),
+	)
+	if err != nil {
+		return wrap(err, "creating trace provider")
+	}
+	global.SetTraceProvider(provider)
+
+	s.stopTracing = func() {
+		err := exporter.Stop()
+		if err != nil {
+			s.logger.Error("stopping OTLP exporter", "err", err)
+		}
+	}
+	return nil
+}
+
+// trace is a middleware starting a span for each request, continuing the
+// trace context found in the headers.
+func (s *service) trace(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	othttp.NewHandler(next, "request").ServeHTTP(rw, r)
+}
+
+// traceRequestID annotates the request span with its id, to correlate it
+// with the logs.
+func traceRequestID(ctx context.Context, id string) {
+	trace.SpanFromContext(ctx).SetAttributes(kv.String("uid", id))
+}
+
+// traceStage records a span for a stage of a request, started at the given
+// time and ending now.
+func traceStage(ctx context.Context, uid, stage string, start time.Time) {
+	_, span := global.Tracer(tracerName).Start(ctx, stage, trace.WithStartTime(start))
+	span.SetAttributes(kv.String("uid", uid))
+	span.End()
+}
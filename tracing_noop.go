@@ -0,0 +1,28 @@
+//go:build !otel
+// +build !otel
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// initTracing refuses an OTLP endpoint, as tracing support is only built with
+// the otel tag.
+func (s *service) initTracing() error {
+	if s.otlpEndpoint != "" {
+		return errors.New("tracing support not built, rebuild with -tags otel to use -otlp-endpoint")
+	}
+	return nil
+}
+
+func (s *service) trace(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(rw, r)
+}
+
+func traceRequestID(ctx context.Context, id string) {}
+
+func traceStage(ctx context.Context, uid, stage string, start time.Time) {}
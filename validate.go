@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// validateResponse is returned when a payload is valid.
+type validateResponse struct {
+	OK bool `json:"ok"`
+}
+
+// validateErrors is returned when a payload is invalid: the first error, as
+// by the other endpoints, along with all of them.
+type validateErrors struct {
+	Error
+	Errors []Error `json:"errors"`
+}
+
+// validatePayload checks a payload the way root does, without decoding the base nor
+// drawing anything, so clients can check their input cheaply. Unlike root, it
+// reports every error found resolving the payload, not only the first one.
+func (s *service) validatePayload(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := s.newGenerateRequest(r)
+	req.init()
+	req.readPayload()
+	req.resolve()
+	if req.err == nil {
+		write(rw, http.StatusOK, validateResponse{OK: true})
+		return
+	}
+
+	errs := req.errs
+	if len(errs) == 0 {
+		errs = []error{req.err}
+	}
+
+	var res validateErrors
+	for _, err := range errs {
+		res.Errors = append(res.Errors, Error{
+			Err:  err.Error(),
+			Code: errorCode(status(err), err),
+		})
+	}
+	res.Error = res.Errors[0]
+	write(rw, status(req.err), res)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidatePayload(t *testing.T) {
+	s := newTestService(t)
+
+	for _, c := range []struct {
+		name   string
+		query  string
+		body   string
+		status int
+		codes  []string
+	}{
+		{
+			name:   "valid",
+			body:   `{"question": "Question ?", "answers": ["Oui", "Non"], "correct": 0}`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "malformed",
+			body:   `{"question": `,
+			status: http.StatusBadRequest,
+			codes:  []string{codeInvalidPayload},
+		},
+		{
+			name:   "unknown base",
+			query:  "dpi=zero",
+			body:   `{"base": "unknown", "question": "Question ?"}`,
+			status: http.StatusBadRequest,
+			codes:  []string{codeInvalidOption, codeUnknownBase},
+		},
+		{
+			name:   "several errors",
+			query:  "dpi=zero&colors=1",
+			body:   `{"question": "Question ?", "answers": ["Oui", {"text": "Non", "size": -1}], "correct": 4, "highlight": "orange"}`,
+			status: http.StatusBadRequest,
+			codes:  []string{codeInvalidOption, codeInvalidOption, codeInvalidPayload, codeInvalidPayload, codeInvalidPayload},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/validate?"+c.query, strings.NewReader(c.body))
+			r.Header.Set("Content-Type", "application/json")
+			rw := httptest.NewRecorder()
+			s.validatePayload(rw, r, nil)
+
+			if rw.Code != c.status {
+				t.Fatalf("expected status %d, got %d: %s", c.status, rw.Code, rw.Body)
+			}
+			if c.codes == nil {
+				return
+			}
+
+			var res validateErrors
+			err := json.Unmarshal(rw.Body.Bytes(), &res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Errors) != len(c.codes) {
+				t.Fatalf("expected %d errors, got %+v", len(c.codes), res.Errors)
+			}
+			for i, code := range c.codes {
+				if res.Errors[i].Code != code {
+					t.Errorf("error %d: expected code %q, got %q (%s)", i, code, res.Errors[i].Code, res.Errors[i].Err)
+				}
+			}
+			if res.Code != c.codes[0] || res.Err != res.Errors[0].Err {
+				t.Errorf("expected the first error at the top level, got %q (%s)", res.Code, res.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Build information, set at build time:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// versionResponse describes the build of the running binary.
+type versionResponse struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// version reports the build of the running binary.
+func (s *service) version(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	write(rw, http.StatusOK, versionResponse{
+		Version: version,
+		Commit:  commit,
+		Date:    date,
+	})
+}